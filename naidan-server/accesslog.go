@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Access log formats accepted by -log-format.
+const (
+	logFormatCommon  = "common"
+	logFormatCompact = "compact"
+	logFormatJSON    = "json"
+)
+
+// accessLogEntry is one request in the JSON access log format.
+type accessLogEntry struct {
+	Timestamp  string  `json:"timestamp"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+	RemoteAddr string  `json:"remote_addr"`
+	UserAgent  string  `json:"user_agent"`
+	ClientCN   string  `json:"client_cn,omitempty"`
+}
+
+// responseRecorder records the status code and body size written through it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *responseRecorder) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// accessLogHandler writes one line per request to logger in the given format,
+// with the client IP resolved through proxies. Requests for paths in skip
+// (such as the health endpoint) are not logged.
+func accessLogHandler(logger *log.Logger, format string, proxies trustedProxies, skip map[string]bool, next http.Handler) http.Handler {
+	// JSON lines carry their own timestamp, so they bypass the logger prefix.
+	// Each line is emitted with a single Write, keeping concurrent entries intact.
+	jsonLogger := log.New(logger.Writer(), "", 0)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if skip[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec, start, duration := timeRequest(w, r, next)
+
+		switch format {
+		case logFormatCommon:
+			user := "-"
+			if u, _, ok := r.BasicAuth(); ok && u != "" {
+				user = u
+			} else if cn := clientCN(r); cn != "" {
+				user = cn
+			}
+			size := "-"
+			if rec.bytes > 0 {
+				size = strconv.FormatInt(rec.bytes, 10)
+			}
+			logger.Printf("%s - %s [%s] %q %d %s\n", proxies.clientIP(r), user, start.Format("02/Jan/2006:15:04:05 -0700"), r.Method+" "+r.RequestURI+" "+r.Proto, rec.status, size)
+		case logFormatCompact:
+			logger.Printf("%s %s %d %dB %s %s\n", r.Method, r.RequestURI, rec.status, rec.bytes, duration.Round(time.Microsecond), proxies.clientIP(r))
+		case logFormatJSON:
+			line, err := json.Marshal(accessLogEntry{
+				Timestamp:  start.UTC().Format(time.RFC3339Nano),
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Status:     rec.status,
+				Bytes:      rec.bytes,
+				DurationMs: float64(duration.Microseconds()) / 1000,
+				RemoteAddr: proxies.clientIP(r),
+				UserAgent:  r.UserAgent(),
+				ClientCN:   clientCN(r),
+			})
+			if err != nil {
+				logger.Printf("Failed to encode access log entry: %v\n", err)
+				return
+			}
+			jsonLogger.Print(string(line))
+		default:
+			panic(fmt.Sprintf("unknown access log format %q", format))
+		}
+	})
+}
+
+// timeRequest serves r with next, recording the response status and size
+// and when the request started and how long it took to handle.
+func timeRequest(w http.ResponseWriter, r *http.Request, next http.Handler) (*responseRecorder, time.Time, time.Duration) {
+	start := time.Now()
+	rec := &responseRecorder{ResponseWriter: w}
+	next.ServeHTTP(rec, r)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec, start, time.Since(start)
+}
+
+// slowLogHandler logs a warning for every request that takes longer than
+// threshold to handle, independently of the access log.
+func slowLogHandler(logger *log.Logger, threshold time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec, _, duration := timeRequest(w, r, next)
+		if duration > threshold {
+			logger.Printf("Slow request: %s %s took %s (status %d, %d bytes)\n", r.Method, r.RequestURI, duration.Round(time.Millisecond), rec.status, rec.bytes)
+		}
+	})
+}
+
+// clientCN returns the common name of the verified TLS client certificate,
+// if the client presented one.
+func clientCN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// remoteIP returns the IP address of the immediate peer.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
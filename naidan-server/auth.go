@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// basicAuthCredential is one user accepted by basicAuthHandler.
+type basicAuthCredential struct {
+	user     [sha256.Size]byte
+	password [sha256.Size]byte
+}
+
+// parseBasicAuth parses "user:pass" entries given to -basic-auth.
+func parseBasicAuth(entries []string) ([]basicAuthCredential, error) {
+	creds := make([]basicAuthCredential, 0, len(entries))
+	for _, entry := range entries {
+		user, password, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("invalid basic auth entry %q (expected user:pass)", entry)
+		}
+		creds = append(creds, basicAuthCredential{
+			user:     sha256.Sum256([]byte(user)),
+			password: sha256.Sum256([]byte(password)),
+		})
+	}
+	return creds, nil
+}
+
+// basicAuthHandler requires HTTP Basic credentials matching one of creds.
+// Paths in skip (such as the health endpoint) are served without them.
+func basicAuthHandler(creds []basicAuthCredential, skip map[string]bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if skip[r.URL.Path] || checkBasicAuth(r, creds) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="naidan", charset="UTF-8"`)
+		http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// checkBasicAuth reports whether r carries valid credentials. Hashing both
+// sides gives equal-length inputs to ConstantTimeCompare, and every
+// credential is checked so the timing doesn't reveal which user matched.
+func checkBasicAuth(r *http.Request, creds []basicAuthCredential) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userSum := sha256.Sum256([]byte(user))
+	passwordSum := sha256.Sum256([]byte(password))
+	match := 0
+	for _, c := range creds {
+		match |= subtle.ConstantTimeCompare(userSum[:], c.user[:]) & subtle.ConstantTimeCompare(passwordSum[:], c.password[:])
+	}
+	return match == 1
+}
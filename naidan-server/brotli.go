@@ -0,0 +1,16 @@
+//go:build brotli
+
+package main
+
+import (
+	"io"
+
+	"github.com/andybalholm/brotli"
+)
+
+// brotliSupported reports whether on-the-fly Brotli encoding is built in.
+const brotliSupported = true
+
+func newBrotliWriter(w io.Writer, level int) compressor {
+	return brotli.NewWriterLevel(w, level)
+}
@@ -0,0 +1,13 @@
+//go:build !brotli
+
+package main
+
+import "io"
+
+// brotliSupported reports whether on-the-fly Brotli encoding is built in.
+// Build with -tags brotli to enable it.
+const brotliSupported = false
+
+func newBrotliWriter(w io.Writer, level int) compressor {
+	panic("brotli support is not built in")
+}
@@ -1,12 +1,35 @@
+//go:build ignore
+
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"os/signal"
+	pathpkg "path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/fsnotify/fsnotify"
 )
 
 type PackageJSON struct {
@@ -14,80 +37,1184 @@ type PackageJSON struct {
 }
 
 func main() {
-	skipBuild := false
-	for _, arg := range os.Args {
-		if arg == "--skip-build" {
-			skipBuild = true
+	var opts copyOptions
+	var skipBuild, buildAll, strip, brotli, watch, checksum, dryRun, strictVersion bool
+	var targetOS, targetArch, src, dst string
+	fs := flag.NewFlagSet("build.go", flag.ExitOnError)
+	fs.BoolVar(&skipBuild, "skip-build", false, "Only prepare the assets, without running go build")
+	fs.BoolVar(&opts.incremental, "incremental", false, "Only copy assets that changed since the last build, and remove stale ones")
+	fs.BoolVar(&opts.followSymlinks, "follow-symlinks", false, "Copy what symlinks point to instead of recreating the links; implied unless --skip-build, since go:embed skips symlinks")
+	fs.BoolVar(&opts.compress, "compress", false, "Write .gz and .br variants of compressible assets")
+	fs.Var((*manifestFlag)(&opts.manifest), "manifest", "Write a SHA-256 manifest of the assets, to manifest.json or the given `file`")
+	fs.BoolVar(&opts.fingerprint, "fingerprint", false, "Rename assets to include a content hash and rewrite references to them")
+	fs.Var((*sizeFlag)(&opts.bufferSize), "buffer-size", "Copy buffer `size` per worker, e.g. 1MiB")
+	fs.BoolVar(&buildAll, "all", false, "Build for every supported platform")
+	fs.StringVar(&targetOS, "os", "", "Target operating system (GOOS)")
+	fs.StringVar(&targetArch, "arch", "", "Target architecture (GOARCH)")
+	fs.BoolVar(&strip, "strip", false, "Drop debug information from the binaries")
+	fs.BoolVar(&brotli, "brotli", false, "Build in on-the-fly Brotli compression (-tags brotli)")
+	fs.BoolVar(&watch, "watch", false, "Keep running, and sync the assets (and rebuild) whenever they change")
+	fs.BoolVar(&checksum, "checksum", false, "Write the SHA-256 of the binaries in sha256sum format")
+	fs.BoolVar(&dryRun, "dry-run", false, "Print what would be done without changing anything")
+	fs.BoolVar(&strictVersion, "strict-version", false, "Fail when package.json has no semver version")
+	fs.StringVar(&src, "src", filepath.Join("..", "dist", "hosted"), "Front-end build to copy the assets from")
+	fs.StringVar(&dst, "dst", "public", "Directory to copy the assets to")
+	fs.Parse(os.Args[1:])
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Error: unexpected argument %q\n", fs.Arg(0))
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// Check before touching dst, so a missing front-end build doesn't cost
+	// the assets already in place
+	if info, err := os.Stat(src); err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "Error: front-end build not found at %s\n", src)
+		fmt.Fprintln(os.Stderr, "Build it first by running `npm run build:hosted` (or `npm run build`) in the repository root.")
+		os.Exit(1)
+	}
+
+	if nested, err := isNested(src, dst); err != nil {
+		fmt.Fprintf(os.Stderr, "Error resolving --src and --dst: %v\n", err)
+		os.Exit(1)
+	} else if nested {
+		fmt.Fprintf(os.Stderr, "Error: --src %s and --dst %s must not contain one another\n", src, dst)
+		os.Exit(1)
+	}
+	// go:embed leaves symlinks out of the binary, so the embedded tree needs
+	// the files they point to
+	if !skipBuild {
+		opts.followSymlinks = true
+	}
+	// The server embeds public, so any other dst is only useful without the build
+	if !skipBuild && filepath.Clean(dst) != "public" {
+		fmt.Fprintln(os.Stderr, "Error: --dst other than public requires --skip-build, the server embeds public")
+		os.Exit(1)
+	}
+
+	// Look for go up front, so a missing toolchain fails before dst is touched
+	if !skipBuild {
+		goPath, err := exec.LookPath("go")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: go not found in PATH, it is needed to build the server")
+			fmt.Fprintf(os.Stderr, "Install Go from https://go.dev/dl/ (build.go itself was compiled with %s), or pass --skip-build to only prepare the assets.\n", runtime.Version())
+			os.Exit(1)
 		}
+		if out, err := exec.Command(goPath, "env", "GOVERSION").Output(); err == nil {
+			fmt.Printf("Using %s from %s\n", strings.TrimSpace(string(out)), goPath)
+		}
+	}
+
+	if dryRun && watch {
+		fmt.Fprintln(os.Stderr, "Error: --dry-run cannot be combined with --watch")
+		os.Exit(1)
+	}
+
+	if opts.fingerprint && (opts.incremental || watch) {
+		fmt.Fprintln(os.Stderr, "Error: --fingerprint cannot be combined with --incremental or --watch")
+		os.Exit(1)
 	}
 
-	src := filepath.Join("..", "dist", "hosted")
-	dst := "public"
+	var targets []buildTarget
+	if buildAll {
+		for _, t := range crossTargets {
+			t.output = filepath.Join("dist", "bin", "naidan-server-"+t.goos+"-"+t.goarch+exeSuffix(t.goos))
+			targets = append(targets, t)
+		}
+	} else {
+		goos := targetOS
+		if goos == "" {
+			goos = runtime.GOOS
+		}
+		targets = append(targets, buildTarget{goos: targetOS, goarch: targetArch, output: "naidan-server" + exeSuffix(goos)})
+	}
+	bopts := buildOptions{targets: targets, strip: strip, brotli: brotli, checksum: checksum}
+	if !skipBuild {
+		version, err := getVersion(strictVersion)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		bopts.version = version
+	}
 
-	fmt.Printf("Cleaning up old assets in %s...\n", dst)
-	os.RemoveAll(dst)
+	if dryRun {
+		if err := planBuild(src, dst, opts, bopts, skipBuild); err != nil {
+			fmt.Fprintf(os.Stderr, "Error %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	fmt.Printf("Copying assets from %s to %s...\n", src, dst)
-	if err := copyDir(src, dst); err != nil {
-		fmt.Fprintf(os.Stderr, "Error copying assets: %v\n", err)
+	// Assemble the tree in a sibling directory and swap it in only once
+	// every step has succeeded, so an interrupted build never leaves a
+	// half-populated dst to be embedded
+	if err := removeStaging(dst); err != nil {
+		fmt.Fprintf(os.Stderr, "Error removing stale staging directories: %v\n", err)
+		os.Exit(1)
+	}
+	staging := fmt.Sprintf("%s.tmp-%d", dst, os.Getpid())
+	fail := func(format string, a ...any) {
+		fmt.Fprintf(os.Stderr, format, a...)
+		os.RemoveAll(staging)
 		os.Exit(1)
 	}
+	var watching atomic.Bool
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupted
+		if watching.Load() {
+			// The usual way to end --watch, not a failure
+			os.RemoveAll(staging)
+			fmt.Printf("Stopped watching %s\n", src)
+			os.Exit(0)
+		}
+		fail("Interrupted, %s left untouched\n", dst)
+	}()
+
+	if _, err := prepareAssets(src, dst, staging, opts, printf); err != nil {
+		fail("Error %v\n", err)
+	}
+	if !watch {
+		signal.Stop(interrupted)
+	}
+	if err := swapDir(staging, dst); err != nil {
+		fail("Error replacing %s: %v\n", dst, err)
+	}
 
 	if skipBuild {
 		fmt.Println("Asset preparation successful (build skipped)")
+	} else {
+		built, err := buildServer(bopts, printf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Build successful:")
+		for _, line := range built {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+	if !watch {
 		return
 	}
 
-	version := getVersion()
-	fmt.Printf("Detected version: %s\n", version)
+	// Later rounds only copy what changed
+	opts.incremental = true
+	fmt.Printf("Watching %s for changes, press Ctrl+C to stop\n", src)
+	watching.Store(true)
+	err := watchDir(src, func() {
+		start := time.Now()
+		counts, err := prepareAssets(src, dst, staging, opts, quiet)
+		if err == nil {
+			err = swapDir(staging, dst)
+		}
+		if err != nil {
+			os.RemoveAll(staging)
+			fmt.Fprintf(os.Stderr, "%s Error %v\n", start.Format(time.TimeOnly), err)
+			return
+		}
+		summary := fmt.Sprintf("copied %d changed files, removed %d stale entries", counts.copied, counts.removed)
+		if !skipBuild {
+			if _, err := buildServer(bopts, quiet); err != nil {
+				fmt.Fprintf(os.Stderr, "%s Error %v\n", start.Format(time.TimeOnly), err)
+				return
+			}
+			summary += ", rebuilt the server"
+		}
+		fmt.Printf("%s Synced: %s (%s)\n", start.Format(time.TimeOnly), summary, time.Since(start).Round(time.Millisecond))
+	})
+	fmt.Fprintf(os.Stderr, "Error watching %s: %v\n", src, err)
+	os.Exit(1)
+}
+
+// planBuild prints what a build with these options would do, without
+// writing anything or running go build.
+func planBuild(src, dst string, opts copyOptions, bopts buildOptions, skipBuild bool) error {
+	fmt.Println("Dry run, nothing will be changed")
+	opts.dryRun = true
+	copied, err := copyDir(src, dst, opts, nil)
+	if err != nil {
+		return fmt.Errorf("listing assets: %w", err)
+	}
+	what := "files"
+	if opts.incremental {
+		what = "changed files"
+	}
+	fmt.Printf("Would copy %d %s from %s to %s\n", len(copied), what, src, dst)
+	for _, rel := range copied {
+		fmt.Printf("  + %s\n", filepath.ToSlash(rel))
+	}
+	if _, err := os.Stat(dst); err == nil {
+		stale, err := removeStale(src, dst, opts)
+		if err != nil {
+			return fmt.Errorf("listing stale assets: %w", err)
+		}
+		fmt.Printf("Would remove %d stale entries from %s\n", len(stale), dst)
+		for _, rel := range stale {
+			fmt.Printf("  - %s\n", filepath.ToSlash(rel))
+		}
+	}
+	if opts.fingerprint {
+		fmt.Printf("Would fingerprint assets and write %s\n", filepath.Join(dst, fingerprintMapFile))
+	}
+	if opts.manifest != "" {
+		fmt.Printf("Would write manifest to %s\n", filepath.Join(dst, opts.manifest))
+	}
+	if opts.compress {
+		fmt.Println("Would write .gz and .br variants of compressible assets")
+	}
+
+	if skipBuild {
+		fmt.Println("Would skip go build")
+		return nil
+	}
+	ldflags, flags := bopts.goFlags(printf)
+	fmt.Printf("Would run go build with %s for:\n", strings.Join(append([]string{"-ldflags", strconv.Quote(ldflags)}, flags...), " "))
+	for _, t := range bopts.targets {
+		fmt.Printf("  %s -> %s\n", t, t.output)
+	}
+	if bopts.checksum {
+		fmt.Printf("Would write checksums to %s\n", checksumFile(bopts.targets))
+	}
+	return nil
+}
+
+// printf and quiet are the progress loggers passed to prepareAssets and
+// buildServer; watch rounds use quiet and print one summary line instead.
+func printf(format string, a ...any) { fmt.Printf(format, a...) }
+func quiet(format string, a ...any)  {}
+
+// copyCounts is what prepareAssets did to the tree.
+type copyCounts struct {
+	copied, removed int
+}
+
+// prepareAssets assembles the assets from src in staging, ready to be
+// swapped in for dst, and reports progress through logf.
+func prepareAssets(src, dst, staging string, opts copyOptions, logf func(string, ...any)) (copyCounts, error) {
+	var counts copyCounts
+	if opts.incremental {
+		logf("Updating changed assets in %s...\n", dst)
+		// Start from the current tree so unchanged files are kept as they are
+		if _, err := os.Stat(dst); err == nil {
+			if err := linkDir(dst, staging, opts.bufferSize); err != nil {
+				return counts, fmt.Errorf("staging current assets: %w", err)
+			}
+		}
+	}
+
+	logf("Copying assets from %s to %s...\n", src, dst)
+	var m *manifest
+	if opts.manifest != "" {
+		m = newManifest()
+	}
+	copied, err := copyDir(src, staging, opts, m)
+	if err != nil {
+		return counts, fmt.Errorf("copying assets: %w", err)
+	}
+	counts.copied = len(copied)
+	if opts.incremental {
+		removed, err := removeStale(src, staging, opts)
+		if err != nil {
+			return counts, fmt.Errorf("removing stale assets: %w", err)
+		}
+		counts.removed = len(removed)
+		logf("Copied %d changed files, removed %d stale entries\n", counts.copied, counts.removed)
+	}
+	if opts.fingerprint {
+		logf("Fingerprinting assets in %s...\n", dst)
+		renamed, err := fingerprintDir(staging)
+		if err != nil {
+			return counts, fmt.Errorf("fingerprinting assets: %w", err)
+		}
+		data, _ := json.MarshalIndent(renamed, "", "  ")
+		if err := removeFile(filepath.Join(staging, fingerprintMapFile)); err != nil {
+			return counts, fmt.Errorf("writing fingerprint map: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(staging, fingerprintMapFile), append(data, '\n'), 0o644); err != nil {
+			return counts, fmt.Errorf("writing fingerprint map: %w", err)
+		}
+		logf("Fingerprinted %d assets, mapping written to %s\n", len(renamed), filepath.Join(dst, fingerprintMapFile))
+		if m != nil {
+			// The copied names no longer exist; hash the final tree
+			if m, err = manifestOf(staging, opts.manifest); err != nil {
+				return counts, fmt.Errorf("hashing assets: %w", err)
+			}
+		}
+	}
+	if m != nil {
+		if err := m.write(filepath.Join(staging, opts.manifest)); err != nil {
+			return counts, fmt.Errorf("writing manifest: %w", err)
+		}
+		logf("Wrote manifest of %d assets to %s\n", len(m.assets), filepath.Join(dst, opts.manifest))
+	}
+	if opts.compress {
+		logf("Compressing assets in %s...\n", dst)
+		var stats compressStats
+		if err := compressDir(staging, opts, &stats); err != nil {
+			return counts, fmt.Errorf("compressing assets: %w", err)
+		}
+		logf("Compressed %d files, saving %d bytes with gzip and %d bytes with brotli\n", stats.files, stats.gzipSaved, stats.brotliSaved)
+	}
+	return counts, nil
+}
+
+// buildOptions are the build.go flags that affect buildServer.
+type buildOptions struct {
+	targets []buildTarget
+	// version is stamped into the binaries
+	version string
+	// strip drops debug information from the binaries
+	strip bool
+	// brotli builds in on-the-fly Brotli compression
+	brotli bool
+	// checksum writes the SHA-256 of the binaries in sha256sum format
+	checksum bool
+}
+
+// buildServer builds the server for every target and returns a line per
+// binary naming it and its size. Progress is reported through logf.
+func buildServer(opts buildOptions, logf func(string, ...any)) ([]string, error) {
+	ldflags, buildFlags := opts.goFlags(logf)
+	var built []string
+	for _, t := range opts.targets {
+		// The previous build's size, if any, shows what the flags changed
+		previous := int64(-1)
+		if info, err := os.Stat(t.output); err == nil {
+			previous = info.Size()
+		}
+		logf("Running go build for %s...\n", t)
+		if err := goBuild(t, ldflags, buildFlags); err != nil {
+			return nil, fmt.Errorf("building server for %s: %w", t, err)
+		}
+		line := t.output
+		if info, err := os.Stat(t.output); err == nil {
+			if previous >= 0 {
+				line += fmt.Sprintf(" (%s, was %s)", formatSize(info.Size()), formatSize(previous))
+			} else {
+				line += fmt.Sprintf(" (%s)", formatSize(info.Size()))
+			}
+		}
+		built = append(built, line)
+	}
+	if opts.checksum {
+		path := checksumFile(opts.targets)
+		if err := writeChecksums(path, opts.targets); err != nil {
+			return nil, fmt.Errorf("writing checksums: %w", err)
+		}
+		built = append(built, path)
+	}
+	return built, nil
+}
+
+// goFlags detects the commit to stamp into the binaries and returns the
+// linker flags and extra go build flags for opts.
+func (opts buildOptions) goFlags(logf func(string, ...any)) (string, []string) {
+	version := opts.version
+	commit := getCommit()
+	buildTime := time.Now().UTC().Format(time.RFC3339)
+	logf("Detected version: %s (commit %s)\n", version, commit)
+
+	ldflags := fmt.Sprintf("-X main.version=%s -X main.commit=%s -X main.buildTime=%s", version, commit, buildTime)
+	var buildFlags []string
+	if opts.strip {
+		// Drop the symbol table and DWARF info, and keep local paths out of the binary
+		ldflags += " -s -w"
+		buildFlags = append(buildFlags, "-trimpath")
+	}
+	if opts.brotli {
+		// Build in on-the-fly Brotli compression (see brotli.go)
+		buildFlags = append(buildFlags, "-tags", "brotli")
+	}
+	return ldflags, buildFlags
+}
+
+// checksumFile is where --checksum writes the checksums of targets: one
+// combined file in the directory of a multi-target build, or a .sha256 file
+// named after the binary otherwise.
+func checksumFile(targets []buildTarget) string {
+	if len(targets) > 1 {
+		return filepath.Join(filepath.Dir(targets[0].output), "SHA256SUMS")
+	}
+	return strings.TrimSuffix(targets[0].output, ".exe") + ".sha256"
+}
+
+// writeChecksums writes the SHA-256 of every target's binary to path in the
+// format of sha256sum, so `sha256sum -c` verifies them from that directory.
+func writeChecksums(path string, targets []buildTarget) error {
+	var b strings.Builder
+	for _, t := range targets {
+		f, err := os.Open(t.output)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Dir(path), t.output)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%x  %s\n", h.Sum(nil), filepath.ToSlash(rel))
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+// watchDebounce is how long watchDir waits for the tree to be quiet, so
+// bursts of changes, such as a bundler rewriting its output, trigger one
+// sync.
+const watchDebounce = 200 * time.Millisecond
+
+// watchDir watches dir and its subdirectories with fsnotify and calls
+// onChange once changes have settled. The parent is watched too, so dir
+// being deleted and recreated, as bundlers do on a clean build, is noticed.
+// It only returns on an error; otherwise the process is stopped by a signal.
+func watchDir(dir string, onChange func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	dir = filepath.Clean(dir)
+	if err := w.Add(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if err := addTree(w, dir); err != nil {
+		return err
+	}
+
+	inDir := func(name string) bool {
+		return name == dir || strings.HasPrefix(name, dir+string(filepath.Separator))
+	}
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if !inDir(ev.Name) {
+				continue
+			}
+			if ev.Has(fsnotify.Create) {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					// Already gone again if this fails, which the next
+					// event reports
+					addTree(w, ev.Name)
+				}
+			}
+			debounce.Reset(watchDebounce)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "Warning: watching %s: %v\n", dir, err)
+		case <-debounce.C:
+			if _, err := os.Stat(dir); err != nil {
+				// Deleted; wait for it to be created again
+				continue
+			}
+			onChange()
+		}
+	}
+}
+
+// addTree adds dir and every directory below it to w.
+func addTree(w *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return w.Add(path)
+	})
+}
+
+// sizeUnits are the suffixes accepted by parseSize, longest first.
+var sizeUnits = []struct {
+	suffix string
+	size   int
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+// parseSize parses a byte count with an optional unit, e.g. "4MiB".
+func parseSize(s string) (int, error) {
+	unit := 1
+	for _, u := range sizeUnits {
+		if n, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, unit = n, u.size
+			break
+		}
+	}
+	n, err := strconv.Atoi(s)
+	return n * unit, err
+}
+
+// sizeFlag is a positive byte count flag parsed by parseSize.
+type sizeFlag int
+
+func (f *sizeFlag) String() string { return strconv.Itoa(int(*f)) }
+
+func (f *sizeFlag) Set(s string) error {
+	size, err := parseSize(s)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("expected a size like 1MiB")
+	}
+	*f = sizeFlag(size)
+	return nil
+}
+
+// manifestFlag is --manifest, which names manifest.json when given without
+// a value.
+type manifestFlag string
 
-	fmt.Println("Running go build...")
-	ldflags := fmt.Sprintf("-X main.version=%s", version)
-	cmd := exec.Command("go", "build", "-ldflags", ldflags, "-o", "naidan-server", "main.go")
+func (f *manifestFlag) String() string   { return string(*f) }
+func (f *manifestFlag) IsBoolFlag() bool { return true }
+
+func (f *manifestFlag) Set(s string) error {
+	switch s {
+	case "true":
+		*f = "manifest.json"
+	case "false":
+		*f = ""
+	default:
+		*f = manifestFlag(s)
+	}
+	return nil
+}
+
+// formatSize formats n bytes for humans, e.g. "12.3 MiB".
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// buildTarget is a platform to build the server for. Empty fields mean the
+// host's.
+type buildTarget struct {
+	goos, goarch string
+	output       string
+}
+
+func (t buildTarget) String() string {
+	goos, goarch := t.goos, t.goarch
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+	return goos + "/" + goarch
+}
+
+// crossTargets are the platforms built by --all.
+var crossTargets = []buildTarget{
+	{goos: "linux", goarch: "amd64"},
+	{goos: "linux", goarch: "arm64"},
+	{goos: "darwin", goarch: "amd64"},
+	{goos: "darwin", goarch: "arm64"},
+	{goos: "windows", goarch: "amd64"},
+	{goos: "windows", goarch: "arm64"},
+	{goos: "freebsd", goarch: "amd64"},
+}
+
+func exeSuffix(goos string) string {
+	if goos == "windows" {
+		return ".exe"
+	}
+	return ""
+}
+
+// goBuild builds the server for t with the given linker flags and extra
+// go build flags.
+func goBuild(t buildTarget, ldflags string, flags []string) error {
+	args := append([]string{"build", "-ldflags", ldflags}, flags...)
+	cmd := exec.Command("go", append(args, "-o", t.output, ".")...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error building server: %v\n", err)
-		os.Exit(1)
+	if t.goos != "" || t.goarch != "" {
+		// Cross builds can't use the host's C toolchain
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+		if t.goos != "" {
+			cmd.Env = append(cmd.Env, "GOOS="+t.goos)
+		}
+		if t.goarch != "" {
+			cmd.Env = append(cmd.Env, "GOARCH="+t.goarch)
+		}
 	}
+	return cmd.Run()
+}
 
-	fmt.Println("Build successful: naidan-server")
+// isNested reports whether a and b are the same directory or one contains
+// the other.
+func isNested(a, b string) (bool, error) {
+	a, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	if b, err = filepath.Abs(b); err != nil {
+		return false, err
+	}
+	within := func(parent, child string) bool {
+		rel, err := filepath.Rel(parent, child)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	return within(a, b) || within(b, a), nil
 }
 
-func getVersion() string {
+// removeStaging removes staging directories left next to dst by builds that
+// were killed before they could clean up.
+func removeStaging(dst string) error {
+	tmp, err := filepath.Glob(dst + ".tmp-*")
+	if err != nil {
+		return err
+	}
+	old, err := filepath.Glob(dst + ".old-*")
+	if err != nil {
+		return err
+	}
+	for _, dir := range append(tmp, old...) {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swapDir replaces dst with staging. A directory can't be renamed over a
+// non-empty one, so the old dst is moved aside first and restored if the
+// second rename fails.
+func swapDir(staging, dst string) error {
+	old := strings.Replace(staging, ".tmp-", ".old-", 1)
+	if err := os.Rename(dst, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(staging, dst); err != nil {
+		os.Rename(old, dst)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// semverPattern matches a semantic version, major.minor.patch with optional
+// pre-release and build metadata, as given on semver.org.
+var semverPattern = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+	`(?:-(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(?:\.(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*)?` +
+	`(?:\+[0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*)?$`)
+
+// getVersion reads the version from package.json, or returns "unknown" if
+// it can't be read. A version that isn't semver is an error with strict set,
+// and gives a warning and "unknown" otherwise.
+func getVersion(strict bool) (string, error) {
 	data, err := os.ReadFile(filepath.Join("..", "package.json"))
 	if err != nil {
-		return "unknown"
+		return "unknown", nil
 	}
 	var pkg PackageJSON
 	if err := json.Unmarshal(data, &pkg); err != nil {
+		return "unknown", nil
+	}
+	if !semverPattern.MatchString(pkg.Version) {
+		if strict {
+			return "", fmt.Errorf("package.json version %q is not a semantic version like 1.2.3", pkg.Version)
+		}
+		fmt.Printf("Warning: package.json version %q is not a semantic version like 1.2.3, using unknown\n", pkg.Version)
+		return "unknown", nil
+	}
+	return pkg.Version, nil
+}
+
+func getCommit() string {
+	out, err := exec.Command("git", "rev-parse", "--short", "HEAD").Output()
+	if err != nil {
 		return "unknown"
 	}
-	return pkg.Version
+	return strings.TrimSpace(string(out))
+}
+
+// copyOptions are the build.go flags that affect copyDir.
+type copyOptions struct {
+	// incremental skips files whose size and modification time match the
+	// existing copy
+	incremental bool
+	// followSymlinks copies what symlinks point to instead of recreating
+	// the links
+	followSymlinks bool
+	// compress keeps the .gz and .br variants written by compressDir
+	compress bool
+	// fingerprint renames assets to include a content hash
+	fingerprint bool
+	// manifest is the file, relative to the destination, that lists the
+	// hash of every asset; empty disables it
+	manifest string
+	// dryRun only works out what would be copied or removed, without
+	// writing anything
+	dryRun bool
+	// bufferSize is the copy buffer size per worker; 0 keeps io.Copy's
+	bufferSize int
 }
 
-func copyDir(src, dst string) error {
+// copyDir copies the tree at src into dst and returns the files and links
+// copied, relative to dst.
+func copyDir(src, dst string, opts copyOptions, m *manifest) ([]string, error) {
+	// Create the directories first so the workers only copy files
+	var files, unchanged, links []string
+	visited := map[string]bool{}
+	var walk func(root, relRoot string) error
+	walk = func(root, relRoot string) error {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.Join(relRoot, rel)
+			target := filepath.Join(dst, rel)
+
+			if info.Mode()&os.ModeSymlink != 0 {
+				if !opts.followSymlinks {
+					copied, err := copySymlink(path, target, opts.dryRun)
+					if copied {
+						links = append(links, rel)
+					}
+					return err
+				}
+				if info, err = os.Stat(path); err != nil {
+					return err
+				}
+				if info.IsDir() {
+					// Walk doesn't descend into links, so walk the
+					// resolved directory under the link's name
+					real, err := filepath.EvalSymlinks(path)
+					if err != nil {
+						return err
+					}
+					if visited[real] {
+						return fmt.Errorf("symlink loop at %s", path)
+					}
+					visited[real] = true
+					defer delete(visited, real)
+					return walk(real, rel)
+				}
+			}
+
+			if info.IsDir() {
+				if opts.dryRun {
+					return nil
+				}
+				return os.MkdirAll(target, info.Mode())
+			}
+
+			if opts.manifest != "" && rel == filepath.Clean(opts.manifest) {
+				fmt.Printf("Warning: not copying %s, it is replaced by the manifest\n", path)
+				return nil
+			}
+			if opts.incremental && upToDate(info, target) {
+				unchanged = append(unchanged, rel)
+				return nil
+			}
+			files = append(files, rel)
+			return nil
+		})
+	}
+	if real, err := filepath.EvalSymlinks(src); err == nil {
+		visited[real] = true
+	}
+	if err := walk(src, "."); err != nil {
+		return nil, err
+	}
+	copied := append(files, links...)
+	if opts.dryRun {
+		return copied, nil
+	}
+	if m != nil {
+		if err := m.addFiles(dst, unchanged); err != nil {
+			return nil, err
+		}
+	}
+	return copied, copyFiles(src, dst, files, m, opts.bufferSize)
+}
+
+// linkDir recreates the tree at src in dst with hard links to its files, so
+// staging an incremental build writes no file data. Files that can't be
+// linked, e.g. across devices, are copied. Everything that later writes into
+// the staged tree goes through removeFile first, so it never changes the
+// linked files of src.
+func linkDir(src, dst string, bufferSize int) error {
+	buf := make([]byte, max(bufferSize, 32<<10))
 	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-
 		rel, err := filepath.Rel(src, path)
 		if err != nil {
 			return err
 		}
-
 		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode())
+		case info.Mode()&os.ModeSymlink != 0:
+			_, err := copySymlink(path, target, false)
+			return err
+		}
+		if err := os.Link(path, target); err == nil {
+			return nil
+		}
+		_, err = copyFile(path, target, nil, buf)
+		return err
+	})
+}
+
+// removeFile deletes path if it exists, so what is written there next is a
+// new file rather than one hard-linked by linkDir.
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
 
+// copySymlink recreates the symlink src at dst, unless dst already is a link
+// with the same target. It reports whether it created the link, or would
+// have with dryRun set.
+func copySymlink(src, dst string, dryRun bool) (bool, error) {
+	linkTarget, err := os.Readlink(src)
+	if err != nil {
+		return false, err
+	}
+	if existing, err := os.Readlink(dst); err == nil && existing == linkTarget {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return false, err
+	}
+	return true, os.Symlink(linkTarget, dst)
+}
+
+// upToDate reports whether dst is a regular file with the size and
+// modification time of the source described by info.
+func upToDate(info os.FileInfo, dst string) bool {
+	di, err := os.Lstat(dst)
+	return err == nil && di.Mode().IsRegular() && di.Size() == info.Size() && di.ModTime().Equal(info.ModTime())
+}
+
+// isVariant reports whether rel is a .gz or .br file written by
+// compressDir for a file that still exists in src.
+func isVariant(src, rel string) bool {
+	ext := filepath.Ext(rel)
+	if ext != ".gz" && ext != ".br" {
+		return false
+	}
+	if _, err := os.Lstat(filepath.Join(src, rel)); err == nil {
+		// Shipped by the front-end build itself
+		return false
+	}
+	_, err := os.Stat(filepath.Join(src, strings.TrimSuffix(rel, ext)))
+	return err == nil
+}
+
+// removeStale deletes entries under dst that don't exist in src, or whose
+// type differs, and returns them relative to dst. With opts.dryRun it only
+// lists them.
+func removeStale(src, dst string, opts copyOptions) ([]string, error) {
+	stat := os.Lstat
+	if opts.followSymlinks {
+		stat = os.Stat
+	}
+	var removed []string
+	err := filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dst, path)
+		if err != nil {
+			return err
+		}
+
+		if rel == filepath.Clean(opts.manifest) || opts.compress && isVariant(src, rel) {
+			return nil
+		}
+		si, err := stat(filepath.Join(src, rel))
+		if err == nil && si.IsDir() == info.IsDir() && (si.Mode()&os.ModeSymlink) == (info.Mode()&os.ModeSymlink) {
+			return nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if !opts.dryRun {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+		removed = append(removed, rel)
 		if info.IsDir() {
-			return os.MkdirAll(target, info.Mode())
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// copyFiles copies files, given relative to src, into dst in parallel and
+// adds them to m unless it is nil. A positive bufferSize copies through a
+// buffer of that size, one per worker.
+func copyFiles(src, dst string, files []string, m *manifest, bufferSize int) error {
+	var buffers sync.Pool
+	if bufferSize > 0 {
+		buffers.New = func() any {
+			buf := make([]byte, bufferSize)
+			return &buf
+		}
+	}
+	return forEachParallel(files, func(rel string) error {
+		var buf []byte
+		if bufferSize > 0 {
+			p := buffers.Get().(*[]byte)
+			defer buffers.Put(p)
+			buf = *p
+		}
+		if m == nil {
+			_, err := copyFile(filepath.Join(src, rel), filepath.Join(dst, rel), nil, buf)
+			return err
+		}
+		h := sha256.New()
+		n, err := copyFile(filepath.Join(src, rel), filepath.Join(dst, rel), h, buf)
+		if err != nil {
+			return err
+		}
+		m.add(rel, h.Sum(nil), n)
+		return nil
+	})
+}
+
+// manifestEntry describes one asset in the --manifest file.
+type manifestEntry struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// manifest collects the hashes of the copied assets, keyed by their path
+// relative to the destination with forward slashes.
+type manifest struct {
+	mu     sync.Mutex
+	assets map[string]manifestEntry
+}
+
+func newManifest() *manifest {
+	return &manifest{assets: make(map[string]manifestEntry)}
+}
+
+func (m *manifest) add(rel string, sum []byte, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.assets[filepath.ToSlash(rel)] = manifestEntry{SHA256: hex.EncodeToString(sum), Size: size}
+}
+
+// addFiles hashes files, given relative to dir, that weren't copied.
+func (m *manifest) addFiles(dir string, files []string) error {
+	return forEachParallel(files, func(rel string) error {
+		f, err := os.Open(filepath.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		if err != nil {
+			return err
+		}
+		m.add(rel, h.Sum(nil), n)
+		return nil
+	})
+}
+
+// manifestOf hashes every regular file under dir except the manifest file
+// itself.
+func manifestOf(dir, manifestFile string) (*manifest, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && rel != filepath.Clean(manifestFile) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m := newManifest()
+	return m, m.addFiles(dir, files)
+}
+
+// write saves the manifest as indented JSON to path.
+func (m *manifest) write(path string) error {
+	data, err := json.MarshalIndent(m.assets, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := removeFile(path); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// forEachParallel calls fn for every item with one worker per CPU. The first
+// error stops the remaining calls and is returned.
+func forEachParallel(items []string, fn func(string) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	jobs := make(chan string)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				if err := fn(item); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, item := range items {
+		select {
+		case jobs <- item:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return firstErr
+}
+
+// compressMinSize is the smallest file --compress writes variants for;
+// below it the savings don't outweigh the extra request handling.
+const compressMinSize = 1024
+
+// compressibleExts are the file types --compress writes variants for.
+var compressibleExts = map[string]bool{
+	".html": true, ".css": true, ".js": true, ".mjs": true,
+	".json": true, ".svg": true, ".wasm": true,
+}
+
+// compressStats counts the bytes saved by compressDir per encoding.
+type compressStats struct {
+	mu          sync.Mutex
+	files       int
+	gzipSaved   int64
+	brotliSaved int64
+}
+
+// compressDir writes .gz and .br siblings of the compressible files under dir. Variants that aren't smaller
+// than the original are dropped. In incremental mode, variants whose
+// modification time matches the original are kept as they are.
+func compressDir(dir string, opts copyOptions, stats *compressStats) error {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
+		if info.Mode().IsRegular() && info.Size() >= compressMinSize && compressibleExts[filepath.Ext(path)] {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		return copyFile(path, target)
+	return forEachParallel(files, func(path string) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		gzSaved, err := writeVariant(path, ".gz", info, opts, gzipFile)
+		if err != nil {
+			return err
+		}
+		brSaved, err := writeVariant(path, ".br", info, opts, brotliFile)
+		if err != nil {
+			return err
+		}
+		stats.mu.Lock()
+		stats.files++
+		stats.gzipSaved += gzSaved
+		stats.brotliSaved += brSaved
+		stats.mu.Unlock()
+		return nil
 	})
 }
 
-func copyFile(src, dst string) error {
+// writeVariant writes path+ext with compress and returns the bytes saved.
+func writeVariant(path, ext string, info os.FileInfo, opts copyOptions, compress func(src, dst string) error) (int64, error) {
+	dst := path + ext
+	if opts.incremental {
+		if vi, err := os.Stat(dst); err == nil && vi.ModTime().Equal(info.ModTime()) {
+			return info.Size() - vi.Size(), nil
+		}
+	}
+	if err := removeFile(dst); err != nil {
+		return 0, err
+	}
+	if err := compress(path, dst); err != nil {
+		return 0, fmt.Errorf("compress %s: %w", path, err)
+	}
+	vi, err := os.Stat(dst)
+	if err != nil {
+		return 0, err
+	}
+	if vi.Size() >= info.Size() {
+		return 0, os.Remove(dst)
+	}
+	return info.Size() - vi.Size(), os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// gzipFile writes src compressed with gzip at the best compression to dst.
+func gzipFile(src, dst string) error {
 	in, err := os.Open(src)
 	if err != nil {
 		return err
@@ -100,13 +1227,336 @@ func copyFile(src, dst string) error {
 	}
 	defer out.Close()
 
-	if _, err := io.Copy(out, in); err != nil {
+	zw, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
 		return err
 	}
+	return out.Close()
+}
+
+// brotliFile writes src compressed with Brotli at the best compression to
+// dst.
+func brotliFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	bw := brotli.NewWriterLevel(out, brotli.BestCompression)
+	if _, err := io.Copy(bw, in); err != nil {
+		return err
+	}
+	if err := bw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// copyFile copies src to dst, also writing the content to tee unless it is
+// nil, and returns the number of bytes copied. The data goes through buf
+// unless it is nil.
+func copyFile(src, dst string, tee io.Writer, buf []byte) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	if err := removeFile(dst); err != nil {
+		return 0, err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	var w io.Writer = out
+	if tee != nil {
+		w = io.MultiWriter(out, tee)
+	}
+	var n int64
+	if buf != nil {
+		// Hide ReadFrom and WriteTo, which would bypass buf
+		n, err = io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{in}, buf)
+	} else {
+		n, err = io.Copy(w, in)
+	}
+	if err != nil {
+		return n, err
+	}
 
 	si, err := os.Stat(src)
 	if err != nil {
+		return n, err
+	}
+	if err := os.Chmod(dst, si.Mode()); err != nil {
+		return n, err
+	}
+	// Keep the modification time so --incremental can tell the copy is current
+	return n, os.Chtimes(dst, si.ModTime(), si.ModTime())
+}
+
+// fingerprintMapFile is written to the destination by --fingerprint and maps
+// original asset paths to the fingerprinted ones.
+const fingerprintMapFile = "fingerprints.json"
+
+// fingerprintExts are the file types --fingerprint renames. HTML pages and
+// files fetched by fixed names, like robots.txt or those in fixedNames, keep
+// their names.
+var fingerprintExts = map[string]bool{
+	".js": true, ".mjs": true, ".css": true, ".wasm": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".avif": true, ".svg": true, ".ico": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true,
+	".mp3": true, ".mp4": true, ".webm": true, ".ogg": true,
+}
+
+// fixedNames are files in the root of the tree that browsers request by
+// name, or that must keep theirs to keep working, such as the service worker
+// generated by VitePWA, whose URL is its registration's identity.
+var fixedNames = map[string]bool{
+	"favicon.ico": true, "apple-touch-icon.png": true, "apple-touch-icon-precomposed.png": true,
+	"sw.js": true, "service-worker.js": true,
+}
+
+// referenceExts are the text files whose references to fingerprinted assets
+// are rewritten.
+var referenceExts = map[string]bool{
+	".html": true, ".css": true, ".js": true, ".mjs": true, ".json": true, ".svg": true, ".webmanifest": true,
+}
+
+// hashedNamePattern matches names that already carry a content hash, like
+// those emitted by the front-end bundler.
+var hashedNamePattern = regexp.MustCompile(`[.-][0-9a-f]{8,}\.`)
+
+// fingerprintDir renames the assets under dir to include a hash of their
+// content, e.g. app.js to app.3f9a1c2b.js, and rewrites references to them
+// in text files. It returns the renames keyed by original path relative to
+// dir, with forward slashes.
+//
+// Text assets are hashed after their own references have been rewritten, in
+// dependency order, so that a changed image also renames the stylesheet
+// using it. Assets that reference each other in a cycle are hashed before
+// all their references are known.
+func fingerprintDir(dir string) (map[string]string, error) {
+	var assets, texts []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		ext := filepath.Ext(rel)
+		if fingerprintExts[ext] && !fixedNames[rel] && !hashedNamePattern.MatchString(filepath.Base(rel)) {
+			assets = append(assets, rel)
+		}
+		if referenceExts[ext] {
+			texts = append(texts, rel)
+		}
+		return nil
+	})
+	if err != nil || len(assets) == 0 {
+		return map[string]string{}, err
+	}
+
+	refs := newReferenceFinder(assets)
+	renamed := make(map[string]string)
+	rename := func(rel string) error {
+		data, err := os.ReadFile(filepath.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		ext := filepath.Ext(rel)
+		hashed := strings.TrimSuffix(rel, ext) + "." + hex.EncodeToString(sum[:4]) + ext
+		if err := os.Rename(filepath.Join(dir, rel), filepath.Join(dir, hashed)); err != nil {
+			return err
+		}
+		renamed[rel] = hashed
+		return nil
+	}
+
+	// Hash dependencies before the files that reference them
+	deps := make(map[string][]string)
+	for _, rel := range assets {
+		if referenceExts[filepath.Ext(rel)] {
+			data, err := os.ReadFile(filepath.Join(dir, rel))
+			if err != nil {
+				return nil, err
+			}
+			deps[rel] = refs.find(rel, data)
+		}
+	}
+	done := make(map[string]bool)
+	for len(done) < len(assets) {
+		progress := false
+		for _, rel := range assets {
+			if done[rel] || !allDone(deps[rel], done, rel) {
+				continue
+			}
+			if referenceExts[filepath.Ext(rel)] {
+				if err := refs.rewrite(dir, rel, renamed); err != nil {
+					return nil, err
+				}
+			}
+			if err := rename(rel); err != nil {
+				return nil, err
+			}
+			done[rel] = true
+			progress = true
+		}
+		if !progress {
+			// Break a cycle by taking the first remaining asset as is
+			for _, rel := range assets {
+				if !done[rel] {
+					deps[rel] = nil
+					break
+				}
+			}
+		}
+	}
+
+	// Rewrite the files that keep their names, and any cycles left over
+	for _, rel := range texts {
+		if hashed, ok := renamed[rel]; ok {
+			rel = hashed
+		}
+		if err := refs.rewrite(dir, rel, renamed); err != nil {
+			return nil, err
+		}
+	}
+	return renamed, nil
+}
+
+// allDone reports whether every dependency other than self is in done.
+func allDone(deps []string, done map[string]bool, self string) bool {
+	for _, d := range deps {
+		if d != self && !done[d] {
+			return false
+		}
+	}
+	return true
+}
+
+// referenceFinder locates references to a set of assets in text files. A
+// reference is the asset's file name, optionally preceded by a relative or
+// root-relative path, e.g. "./app.js", "../img/logo.png", or
+// "/assets/app.js". URLs with a scheme or host, like
+// "https://example.com/app.js", point elsewhere and are left alone.
+type referenceFinder struct {
+	re     *regexp.Regexp
+	assets map[string]bool
+	byName map[string][]string
+}
+
+func newReferenceFinder(assets []string) *referenceFinder {
+	f := &referenceFinder{assets: make(map[string]bool), byName: make(map[string][]string)}
+	var names []string
+	for _, rel := range assets {
+		f.assets[rel] = true
+		name := filepath.Base(rel)
+		if f.byName[name] == nil {
+			names = append(names, regexp.QuoteMeta(name))
+		}
+		f.byName[name] = append(f.byName[name], rel)
+	}
+	// Longest names first so that app.js.map isn't matched as app.js
+	slices.SortFunc(names, func(a, b string) int { return len(b) - len(a) })
+	f.re = regexp.MustCompile(`((?:[a-zA-Z][a-zA-Z0-9+.-]*:)?[\w.~@/-]*?)(` + strings.Join(names, "|") + `)([^\w.-]|$)`)
+	return f
+}
+
+// resolve returns the asset a reference in the file from points to, if any.
+func (f *referenceFinder) resolve(from, prefix, name string) (string, bool) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		// Part of a longer name, like myapp.js for app.js
+		return "", false
+	}
+	if strings.HasPrefix(prefix, "//") || strings.Contains(prefix, ":") {
+		// On another host, or not a path at all, like data: or mailto:
+		return "", false
+	}
+	var candidate string
+	if strings.HasPrefix(prefix, "/") {
+		candidate = strings.TrimPrefix(pathpkg.Clean(prefix+name), "/")
+	} else {
+		candidate = pathpkg.Join(pathpkg.Dir(from), prefix, name)
+	}
+	if f.assets[candidate] {
+		return candidate, true
+	}
+	// Served under a base path or resolved against the page URL instead of
+	// the file; use the name if it is unambiguous
+	if rels := f.byName[name]; len(rels) == 1 {
+		return rels[0], true
+	}
+	return "", false
+}
+
+// find returns the assets referenced by data, the content of from.
+func (f *referenceFinder) find(from string, data []byte) []string {
+	var found []string
+	for _, m := range f.re.FindAllSubmatch(data, -1) {
+		if rel, ok := f.resolve(from, string(m[1]), string(m[2])); ok && !slices.Contains(found, rel) {
+			found = append(found, rel)
+		}
+	}
+	return found
+}
+
+// rewrite replaces references in dir/rel to assets renamed so far.
+func (f *referenceFinder) rewrite(dir, rel string, renamed map[string]string) error {
+	path := filepath.Join(dir, rel)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	from := rel
+	for orig, hashed := range renamed {
+		if hashed == rel {
+			from = orig
+		}
+	}
+	out := f.re.ReplaceAllFunc(data, func(match []byte) []byte {
+		m := f.re.FindSubmatch(match)
+		target, ok := f.resolve(from, string(m[1]), string(m[2]))
+		if !ok {
+			return match
+		}
+		hashed, ok := renamed[target]
+		if !ok {
+			return match
+		}
+		return slices.Concat(m[1], []byte(pathpkg.Base(hashed)), m[3])
+	})
+	if bytes.Equal(out, data) {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := removeFile(path); err != nil {
 		return err
 	}
-	return os.Chmod(dst, si.Mode())
+	return os.WriteFile(path, out, info.Mode())
 }
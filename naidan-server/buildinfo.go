@@ -0,0 +1,48 @@
+package main
+
+import "runtime/debug"
+
+// modified reports whether the binary was built from a working tree with
+// uncommitted changes. It is only known when the Go toolchain stamped VCS
+// information into the binary.
+var modified bool
+
+// init fills in build details that were not set with -ldflags from the
+// module and VCS information the Go toolchain embeds, so a plain `go build`
+// still reports where the binary came from. Values set with -ldflags win.
+func init() {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if version == "dev" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if commit == "unknown" {
+				commit = s.Value
+				if len(commit) > 7 {
+					commit = commit[:7]
+				}
+			}
+		case "vcs.time":
+			// The commit time, the closest thing to a build time available
+			if buildTime == "unknown" {
+				buildTime = s.Value
+			}
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+}
+
+// versionString describes the build for --version.
+func versionString() string {
+	rev := commit
+	if modified {
+		rev += ", modified"
+	}
+	return "naidan-server version " + version + " (commit " + rev + ", built " + buildTime + ")"
+}
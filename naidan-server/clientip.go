@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies decides which peers may report the client IP through
+// X-Forwarded-For or X-Real-IP. The zero value trusts nobody.
+type trustedProxies struct {
+	all  bool
+	nets []*net.IPNet
+}
+
+// newTrustedProxies trusts the given ranges, or any peer when all is set and
+// no ranges are given.
+func newTrustedProxies(all bool, nets []*net.IPNet) trustedProxies {
+	return trustedProxies{all: all && len(nets) == 0, nets: nets}
+}
+
+func (t trustedProxies) trusts(ip net.IP) bool {
+	return ip != nil && (t.all || containsIP(t.nets, ip))
+}
+
+// clientIP returns the IP address of the client that sent r. Forwarding
+// headers are only honoured when the immediate peer is trusted. Then
+// X-Forwarded-For is walked from the right, skipping trusted proxies, and
+// the first untrusted address is the client; without it X-Real-IP is used.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	peer := remoteIP(r)
+	if !t.trusts(net.ParseIP(peer)) {
+		return peer
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	if len(hops) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+		return peer
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// A malformed entry can't be attributed to anyone; stop at
+			// the last address a trusted proxy vouched for.
+			break
+		}
+		client = ip.String()
+		if !t.trusts(ip) {
+			break
+		}
+	}
+	return client
+}
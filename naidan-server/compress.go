@@ -0,0 +1,305 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// isCompressible reports whether responses of the given Content-Type benefit
+// from compression. Images, fonts, and archives are already compressed.
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/javascript", "application/json", "application/xml", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// encodingQualities parses an Accept-Encoding header into the q-value of
+// each coding it lists, keyed in lower case. Entries with a malformed q are
+// ignored.
+func encodingQualities(header string) map[string]float64 {
+	qs := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q, valid := 1.0, true
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.ToLower(strings.TrimSpace(param)), "q="); ok {
+				f, err := strconv.ParseFloat(v, 64)
+				valid = err == nil && f >= 0 && f <= 1
+				q = f
+			}
+		}
+		if valid {
+			qs[coding] = q
+		}
+	}
+	return qs
+}
+
+// negotiateEncoding returns the coding among offered, listed in the server's
+// order of preference, that the request's Accept-Encoding rates highest, so
+// ties go to the earlier one. "*" covers codings the header doesn't name.
+// It returns "" when the client refuses every offered coding with q=0 or
+// rates identity above them, and when there is no Accept-Encoding at all.
+func negotiateEncoding(r *http.Request, offered ...string) string {
+	header := strings.Join(r.Header.Values("Accept-Encoding"), ",")
+	if strings.TrimSpace(header) == "" {
+		return ""
+	}
+	qs := encodingQualities(header)
+	quality := func(coding string) float64 {
+		if q, ok := qs[coding]; ok {
+			return q
+		}
+		return qs["*"]
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range offered {
+		if q := quality(coding); q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	// Identity is always acceptable but only wins when the client says it
+	// prefers it; an unlisted identity states no preference.
+	if best == "" || quality("identity") > bestQ {
+		return ""
+	}
+	return best
+}
+
+// addVary adds value to the Vary header unless it is already listed.
+func addVary(h http.Header, value string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
+
+// precompressedEncodings lists the sibling files looked up by
+// precompressedHandler, in order of preference.
+var precompressedEncodings = []struct {
+	coding string
+	ext    string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// precompressedHandler serves a sibling .br or .gz file, when one exists and
+// the client's Accept-Encoding picks that encoding, in place of the
+// requested file. With
+// skipHTML set, HTML files are served uncompressed so they can be rewritten.
+func precompressedHandler(root http.FileSystem, skipHTML bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") || !isRegularFile(root, name) || (skipHTML && path.Ext(name) == ".html") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		addVary(w.Header(), "Accept-Encoding")
+		var available []string
+		for _, enc := range precompressedEncodings {
+			if isRegularFile(root, name+enc.ext) {
+				available = append(available, enc.coding)
+			}
+		}
+		coding := negotiateEncoding(r, available...)
+		for _, enc := range precompressedEncodings {
+			if enc.coding != coding {
+				continue
+			}
+			// Keep the original type; otherwise the file server would
+			// derive it from the .br/.gz extension.
+			contentType := mime.TypeByExtension(path.Ext(name))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Encoding", enc.coding)
+			next.ServeHTTP(w, withPath(r, name+enc.ext))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// compressor is a compressing writer such as *gzip.Writer.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressHandler compresses compressible responses on the fly, with Brotli
+// when brotliLevel is positive and the server is built with it, and with
+// gzip when gzipLevel is positive, choosing between them by the client's
+// Accept-Encoding q-values and preferring br on a tie.
+// Responses shorter than minSize bytes are sent as they are.
+func compressHandler(gzipLevel, brotliLevel, minSize int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addVary(w.Header(), "Accept-Encoding")
+		var offered []string
+		if brotliSupported && brotliLevel > 0 {
+			offered = append(offered, "br")
+		}
+		if gzipLevel > 0 {
+			offered = append(offered, "gzip")
+		}
+		cw := &compressResponseWriter{ResponseWriter: w, minSize: minSize}
+		switch cw.coding = negotiateEncoding(r, offered...); cw.coding {
+		case "br":
+			cw.newWriter = func(w io.Writer) compressor { return newBrotliWriter(w, brotliLevel) }
+		case "gzip":
+			cw.newWriter = func(w io.Writer) compressor {
+				gz, _ := gzip.NewWriterLevel(w, gzipLevel)
+				return gz
+			}
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressResponseWriter decides whether to compress when the header is
+// written, based on the status code and Content-Type chosen by the wrapped
+// handler. When the length isn't known up front, the body is buffered until
+// it reaches minSize, so short responses can still go out uncompressed.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	coding      string
+	newWriter   func(io.Writer) compressor
+	minSize     int
+	cw          compressor
+	wroteHeader bool
+	buffering   bool
+	buf         []byte
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if code == http.StatusOK && h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		length, err := strconv.Atoi(h.Get("Content-Length"))
+		switch {
+		case err == nil && length < w.minSize:
+			// Too small to be worth it; keep Content-Length as it is.
+		case err == nil || w.minSize <= 0:
+			w.startCompressing()
+			return
+		default:
+			w.buffering = true
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// startCompressing switches the response to w.coding and writes a 200
+// header.
+func (w *compressResponseWriter) startCompressing() {
+	h := w.Header()
+	h.Set("Content-Encoding", w.coding)
+	h.Del("Content-Length")
+	// Ranges of the compressed stream aren't served; Range requests get
+	// a 206 of the identity bytes instead of being compressed
+	h.Del("Accept-Ranges")
+	// The compressed bytes differ from the file, so a strong ETag no
+	// longer applies. A weak one still matches If-None-Match.
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.cw = w.newWriter(w.ResponseWriter)
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+}
+
+// flushBuffer ends buffering, compressing what was buffered when compress
+// is set and sending it as it is otherwise.
+func (w *compressResponseWriter) flushBuffer(compress bool) error {
+	w.buffering = false
+	buf := w.buf
+	w.buf = nil
+	if compress {
+		w.startCompressing()
+		_, err := w.cw.Write(buf)
+		return err
+	}
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffering {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) >= w.minSize {
+			if err := w.flushBuffer(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	if w.cw != nil {
+		return w.cw.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush sends what has been written so far. A still buffered body is
+// compressed, since more of it may follow.
+func (w *compressResponseWriter) Flush() {
+	if w.buffering {
+		w.flushBuffer(true)
+	}
+	if w.cw != nil {
+		w.cw.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close sends a body that stayed below minSize uncompressed, or flushes any
+// buffered compressed data.
+func (w *compressResponseWriter) Close() error {
+	if w.buffering {
+		return w.flushBuffer(false)
+	}
+	if w.cw == nil {
+		return nil
+	}
+	return w.cw.Close()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// concurrencyLimiter caps the number of requests being handled at once.
+type concurrencyLimiter struct {
+	slots    chan struct{}
+	wait     time.Duration
+	rejected atomic.Uint64
+}
+
+// newConcurrencyLimiter allows max requests at once. A request arriving when
+// every slot is taken waits up to wait for one to free up; with a zero wait
+// it is rejected right away.
+func newConcurrencyLimiter(max int, wait time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{slots: make(chan struct{}, max), wait: wait}
+}
+
+// acquire takes a slot, reporting false if none became free in time.
+func (l *concurrencyLimiter) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// inUse returns the number of slots currently taken.
+func (l *concurrencyLimiter) inUse() int {
+	return len(l.slots)
+}
+
+// middleware answers requests over the limit with 503 Service Unavailable.
+// Paths in skip (such as the health and metrics endpoints) are never limited.
+func (l *concurrencyLimiter) middleware(skip map[string]bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if skip[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !l.acquire() {
+			l.rejected.Add(1)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "503 service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		// Deferred so a panicking handler still gives its slot back
+		defer func() { <-l.slots }()
+		next.ServeHTTP(w, r)
+	})
+}
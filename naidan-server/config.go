@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds every setting of the server. Each field has a command-line
+// flag and a key in the -config file.
+type config struct {
+	Port          int      `json:"port"`
+	PortRetry     int      `json:"portRetry"`
+	Ports         []string `json:"ports"`
+	Host          string   `json:"host"`
+	Unix          string   `json:"unix"`
+	Cert          string   `json:"cert"`
+	Key           string   `json:"key"`
+	SelfSigned    bool     `json:"selfSigned"`
+	TLSMinVersion string   `json:"tlsMinVersion"`
+	TLSCiphers    []string `json:"tlsCiphers"`
+	ClientCA      string   `json:"clientCa"`
+	RedirectHTTP  int      `json:"redirectHttp"`
+	H2C           bool     `json:"h2c"`
+	Open          bool     `json:"open"`
+	PIDFile       string   `json:"pidFile"`
+	OnReady       string   `json:"onReady"`
+	User          string   `json:"user"`
+	Group         string   `json:"group"`
+
+	Dir               string   `json:"dir"`
+	Zip               string   `json:"zip"`
+	BasePath          string   `json:"basePath"`
+	Index             string   `json:"index"`
+	NoListing         bool     `json:"noListing"`
+	ListingTemplate   string   `json:"listingTemplate"`
+	AllowDotfiles     bool     `json:"allowDotfiles"`
+	I18nIndex         bool     `json:"i18nIndex"`
+	SPA               bool     `json:"spa"`
+	CleanURLs         bool     `json:"cleanUrls"`
+	CleanURLsRedirect bool     `json:"cleanUrlsRedirect"`
+	TrailingSlash     string   `json:"trailingSlash"`
+	Rewrites          []string `json:"rewrites"`
+	Redirects         []string `json:"redirects"`
+	DefaultRobots     bool     `json:"defaultRobots"`
+	DefaultFavicon    bool     `json:"defaultFavicon"`
+	NotFoundPage      string   `json:"notFoundPage"`
+	MIMETypes         []string `json:"mimeTypes"`
+	LiveReload        bool     `json:"liveReload"`
+	EnvInject         []string `json:"envInject"`
+
+	GzipLevel        int      `json:"gzipLevel"`
+	GzipMinSize      byteSize `json:"gzipMinSize"`
+	BrotliLevel      int      `json:"brotliLevel"`
+	Precompressed    bool     `json:"precompressed"`
+	ETag             bool     `json:"etag"`
+	CacheControl     string   `json:"cacheControl"`
+	CacheHashPattern string   `json:"cacheHashPattern"`
+	NoCache          bool     `json:"noCache"`
+
+	SecurityHeaders bool     `json:"securityHeaders"`
+	CSP             string   `json:"csp"`
+	CSPNonce        bool     `json:"cspNonce"`
+	Headers         []string `json:"headers"`
+	ServerTiming    bool     `json:"serverTiming"`
+	ServerHeader    *string  `json:"serverHeader"`
+	AllowMethods    []string `json:"allowMethods"`
+	Proxies         []string `json:"proxies"`
+	ProxyStrip      bool     `json:"proxyStrip"`
+	MaxBodySize     byteSize `json:"maxBodySize"`
+	CORSOrigins     []string `json:"corsOrigins"`
+	BasicAuth       []string `json:"basicAuth"`
+	AllowIPs        []string `json:"allowIps"`
+	DenyIPs         []string `json:"denyIps"`
+	RateLimit       float64  `json:"rateLimit"`
+	RateBurst       int      `json:"rateBurst"`
+	MaxConnections  int      `json:"maxConnections"`
+	MaxConnWait     duration `json:"maxConnectionsWait"`
+	TrustProxy      bool     `json:"trustProxy"`
+	TrustedProxies  []string `json:"trustedProxies"`
+
+	Maintenance           bool     `json:"maintenance"`
+	MaintenancePage       string   `json:"maintenancePage"`
+	MaintenanceRetryAfter duration `json:"maintenanceRetryAfter"`
+	MaintenanceHealthOK   bool     `json:"maintenanceHealthOk"`
+
+	HealthPath  string `json:"healthPath"`
+	VersionPath string `json:"versionPath"`
+	MetricsPath string `json:"metricsPath"`
+	Debug       bool   `json:"debug"`
+	FilesPath   string `json:"filesPath"`
+
+	Quiet         bool     `json:"quiet"`
+	Verbose       bool     `json:"verbose"`
+	AccessLog     bool     `json:"accessLog"`
+	LogFormat     string   `json:"logFormat"`
+	SlowLog       duration `json:"slowLog"`
+	LogFile       string   `json:"logFile"`
+	LogMaxSize    int      `json:"logMaxSize"`
+	LogMaxBackups int      `json:"logMaxBackups"`
+
+	ReadTimeout      duration `json:"readTimeout"`
+	WriteTimeout     duration `json:"writeTimeout"`
+	IdleTimeout      duration `json:"idleTimeout"`
+	NoKeepAlive      bool     `json:"noKeepAlive"`
+	ShutdownTimeout  duration `json:"shutdownTimeout"`
+	PreShutdownDelay duration `json:"preshutdownDelay"`
+}
+
+// defaultConfig returns the built-in defaults.
+func defaultConfig() config {
+	return config{
+		Port:                  5536,
+		Host:                  "localhost",
+		TLSMinVersion:         "1.2",
+		BasePath:              "/",
+		Index:                 "index.html",
+		TrailingSlash:         trailingSlashKeep,
+		GzipLevel:             6,
+		GzipMinSize:           1 << 10,
+		BrotliLevel:           4,
+		CacheControl:          "max-age=3600",
+		CacheHashPattern:      `[.-][0-9a-f]{8,}\.`,
+		HealthPath:            "/healthz",
+		FilesPath:             "/__files",
+		VersionPath:           "/__version",
+		LogFormat:             logFormatCommon,
+		ReadTimeout:           duration(15 * time.Second),
+		WriteTimeout:          duration(15 * time.Second),
+		IdleTimeout:           duration(60 * time.Second),
+		ShutdownTimeout:       duration(10 * time.Second),
+		MaintenanceRetryAfter: duration(5 * time.Minute),
+		MaxBodySize:           10 << 20,
+		LogMaxSize:            100,
+	}
+}
+
+// commandLine holds the options that only exist on the command line.
+type commandLine struct {
+	configFile  string
+	showVersion bool
+	dumpConfig  bool
+	verify      string
+	// set records the flags given explicitly on the command line
+	set map[string]bool
+}
+
+// newFlagSet returns the flag set of the server with every flag bound to
+// cfg or cl. Flags that are not given keep the value already in cfg.
+func newFlagSet(cfg *config, cl *commandLine) *flag.FlagSet {
+	fs := flag.NewFlagSet("naidan-server", flag.ExitOnError)
+
+	// flag package supports both -name and --name automatically
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "Port to listen on")
+	fs.IntVar(&cfg.Port, "p", cfg.Port, "Port to listen on (shorthand)")
+	fs.Var(newListFlag(&cfg.Ports), "ports", "Listen on the first of these ports that is available (comma-separated)")
+	fs.IntVar(&cfg.PortRetry, "port-retry", cfg.PortRetry, "Try up to this many following ports if the port is in use")
+	fs.StringVar(&cfg.Host, "host", cfg.Host, "Host or interface to bind to")
+	fs.StringVar(&cfg.Unix, "unix", cfg.Unix, "Listen on this Unix domain socket instead of TCP")
+	fs.StringVar(&cfg.Cert, "cert", cfg.Cert, "TLS certificate file (requires -key)")
+	fs.StringVar(&cfg.Key, "key", cfg.Key, "TLS private key file (requires -cert)")
+	fs.BoolVar(&cfg.SelfSigned, "self-signed", cfg.SelfSigned, "Serve HTTPS with a generated self-signed certificate")
+	fs.StringVar(&cfg.TLSMinVersion, "tls-min-version", cfg.TLSMinVersion, "Minimum TLS version: 1.2 or 1.3")
+	fs.Var(newListFlag(&cfg.TLSCiphers), "tls-ciphers", "TLS 1.2 cipher suites to allow (comma-separated, repeatable)")
+	fs.StringVar(&cfg.ClientCA, "client-ca", cfg.ClientCA, "Require client certificates signed by a CA in this PEM bundle")
+	fs.IntVar(&cfg.RedirectHTTP, "redirect-http", cfg.RedirectHTTP, "Also listen on this plain HTTP port and redirect to HTTPS")
+	fs.BoolVar(&cfg.H2C, "h2c", cfg.H2C, "Also accept HTTP/2 over plaintext connections (h2c)")
+	fs.StringVar(&cfg.OnReady, "on-ready", cfg.OnReady, "Run this command once the server is listening")
+	fs.BoolVar(&cfg.Open, "open", cfg.Open, "Open the server URL in the default browser once listening")
+	fs.StringVar(&cfg.User, "user", cfg.User, "Switch to this user after binding the listeners")
+	fs.StringVar(&cfg.Group, "group", cfg.Group, "Switch to this group after binding the listeners")
+	fs.StringVar(&cfg.PIDFile, "pid-file", cfg.PIDFile, "Write the process ID to this file while running")
+
+	fs.StringVar(&cfg.Dir, "dir", cfg.Dir, "Serve files from this directory instead of the embedded assets")
+	fs.StringVar(&cfg.Zip, "zip", cfg.Zip, "Serve files from this ZIP archive instead of the embedded assets")
+	fs.StringVar(&cfg.BasePath, "base-path", cfg.BasePath, "Serve the files under this URL path prefix, e.g. /naidan/")
+	fs.StringVar(&cfg.Index, "index", cfg.Index, "File served for directory requests")
+	fs.BoolVar(&cfg.NoListing, "no-listing", cfg.NoListing, "Don't list directories that have no index file")
+	fs.BoolVar(&cfg.AllowDotfiles, "allow-dotfiles", cfg.AllowDotfiles, "Serve files and directories whose names start with a dot")
+	fs.StringVar(&cfg.ListingTemplate, "listing-template", cfg.ListingTemplate, "html/template file rendering directory listings")
+	fs.BoolVar(&cfg.I18nIndex, "i18n-index", cfg.I18nIndex, "Serve index.<lang>.html matching Accept-Language for directories")
+	fs.BoolVar(&cfg.SPA, "spa", cfg.SPA, "Serve the index file for unknown paths without an extension")
+	fs.BoolVar(&cfg.CleanURLs, "clean-urls", cfg.CleanURLs, "Serve /about from /about.html when /about doesn't exist")
+	fs.BoolVar(&cfg.CleanURLsRedirect, "clean-urls-redirect", cfg.CleanURLsRedirect, "Redirect /about.html to /about (with --clean-urls)")
+	fs.StringVar(&cfg.TrailingSlash, "trailing-slash", cfg.TrailingSlash, "Trailing slash policy: keep, add, or strip")
+	fs.Var(newListFlag(&cfg.Rewrites), "rewrite", "Serve /to for requests to /from, given as /from=/to; a trailing * matches a prefix (repeatable)")
+	fs.Var(newListFlag(&cfg.Redirects), "redirect", "Redirect /from to a path or URL, given as /from=to[=code] (default code 301); a trailing * matches a prefix (repeatable)")
+	fs.BoolVar(&cfg.DefaultRobots, "default-robots", cfg.DefaultRobots, "Serve a built-in robots.txt allowing everything when there is none")
+	fs.BoolVar(&cfg.DefaultFavicon, "default-favicon", cfg.DefaultFavicon, "Serve a built-in favicon.ico when there is none")
+	fs.StringVar(&cfg.NotFoundPage, "404-page", cfg.NotFoundPage, "HTML file, relative to the served files, returned for not-found responses")
+
+	fs.BoolVar(&cfg.LiveReload, "live-reload", cfg.LiveReload, "Reload pages in the browser when files under --dir change")
+	fs.Var(newListFlag(&cfg.EnvInject), "env-inject", "Define KEY=VALUE in window.__ENV of the index file (repeatable)")
+	fs.Var(newListFlag(&cfg.MIMETypes), "mime", "Serve files with this extension as this type, .ext=type/subtype (repeatable)")
+	fs.IntVar(&cfg.GzipLevel, "gzip-level", cfg.GzipLevel, "Gzip compression level (1-9, 0 disables compression)")
+	fs.IntVar(&cfg.BrotliLevel, "br-quality", cfg.BrotliLevel, "Brotli quality for clients that accept it (1-11, 0 disables; needs -tags brotli)")
+	fs.IntVar(&cfg.BrotliLevel, "brotli-level", cfg.BrotliLevel, "Brotli quality (alias of -br-quality)")
+	fs.Var(&cfg.GzipMinSize, "gzip-min-size", "Send responses smaller than this uncompressed, e.g. 1KiB")
+	fs.BoolVar(&cfg.Precompressed, "precompressed", cfg.Precompressed, "Serve existing .br/.gz siblings of requested files")
+	fs.BoolVar(&cfg.ETag, "etag", cfg.ETag, "Send content-based ETags and answer If-None-Match")
+	fs.StringVar(&cfg.CacheControl, "cache-control", cfg.CacheControl, "Default Cache-Control header for static assets")
+	fs.StringVar(&cfg.CacheHashPattern, "cache-hash-pattern", cfg.CacheHashPattern, "Regexp matching content-hashed file names, which are cached as immutable")
+
+	fs.BoolVar(&cfg.NoCache, "no-cache", cfg.NoCache, "Forbid caching of every response and disable ETag and 304 handling")
+
+	fs.BoolVar(&cfg.SecurityHeaders, "security-headers", cfg.SecurityHeaders, "Add X-Content-Type-Options, X-Frame-Options, and Referrer-Policy headers")
+	fs.StringVar(&cfg.CSP, "csp", cfg.CSP, "Content-Security-Policy header value")
+	fs.BoolVar(&cfg.CSPNonce, "csp-nonce", cfg.CSPNonce, "Replace __CSP_NONCE__ in the --csp policy and in HTML pages with a random nonce per response")
+	fs.Var(newListFlag(&cfg.Headers), "header", "Add this \"Name: Value\" header to every response (repeatable)")
+	fs.BoolVar(&cfg.ServerTiming, "server-timing", cfg.ServerTiming, "Report the handler duration in a Server-Timing header")
+	fs.Func("server-header", "Set the Server header to this value, or remove it if empty", func(value string) error {
+		cfg.ServerHeader = &value
+		return nil
+	})
+	fs.Var(newListFlag(&cfg.AllowMethods), "allow-methods", "Also accept these methods besides GET, HEAD, and OPTIONS (comma-separated, repeatable)")
+	fs.Var(newListFlag(&cfg.Proxies), "proxy", "Forward requests under /prefix to a backend, given as /prefix=http://host:port (repeatable)")
+	fs.BoolVar(&cfg.ProxyStrip, "proxy-strip", cfg.ProxyStrip, "Remove the --proxy prefix from the path sent to the backend")
+	fs.Var(&cfg.MaxBodySize, "max-body-size", "Largest request body accepted, e.g. 10MB (0 means no limit)")
+	fs.Var(newListFlag(&cfg.CORSOrigins), "cors-origin", "Allow cross-origin requests from this origin, or * for any (repeatable)")
+	fs.Var(newListFlag(&cfg.BasicAuth), "basic-auth", "Require HTTP Basic credentials user:pass (repeatable)")
+	fs.Var(newListFlag(&cfg.AllowIPs), "allow-ip", "Only allow clients in this CIDR range (repeatable)")
+	fs.Var(newListFlag(&cfg.DenyIPs), "deny-ip", "Reject clients in this CIDR range (repeatable)")
+	fs.Float64Var(&cfg.RateLimit, "rate-limit", cfg.RateLimit, "Maximum requests per second per client IP (0 disables)")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", cfg.RateBurst, "Requests a client may burst above --rate-limit (default: the rate, at least 1)")
+	fs.IntVar(&cfg.MaxConnections, "max-connections", cfg.MaxConnections, "Maximum requests handled at once (0 means no limit)")
+	fs.DurationVar((*time.Duration)(&cfg.MaxConnWait), "max-connections-wait", time.Duration(cfg.MaxConnWait), "How long a request over --max-connections waits for a slot before 503 (0 rejects immediately)")
+	fs.BoolVar(&cfg.TrustProxy, "trust-proxy", cfg.TrustProxy, "Take the client IP from X-Forwarded-For or X-Real-IP set by any peer")
+	fs.Var(newListFlag(&cfg.TrustedProxies), "trusted-proxy", "Only take the client IP from proxies in this CIDR range (comma-separated, repeatable)")
+
+	fs.BoolVar(&cfg.Maintenance, "maintenance", cfg.Maintenance, "Start in maintenance mode, answering every request with 503")
+	fs.StringVar(&cfg.MaintenancePage, "maintenance-page", cfg.MaintenancePage, "HTML file served in maintenance mode")
+	fs.DurationVar((*time.Duration)(&cfg.MaintenanceRetryAfter), "maintenance-retry-after", time.Duration(cfg.MaintenanceRetryAfter), "Retry-After sent in maintenance mode")
+	fs.BoolVar(&cfg.MaintenanceHealthOK, "maintenance-health-ok", cfg.MaintenanceHealthOK, "Keep answering the health endpoint in maintenance mode")
+
+	fs.StringVar(&cfg.HealthPath, "health-path", cfg.HealthPath, "Path of the health-check endpoint (empty disables it)")
+	fs.StringVar(&cfg.VersionPath, "version-path", cfg.VersionPath, "Path of the version endpoint (empty disables it)")
+	fs.StringVar(&cfg.MetricsPath, "metrics-path", cfg.MetricsPath, "Path of the Prometheus metrics endpoint (empty disables it)")
+	fs.BoolVar(&cfg.Debug, "debug", cfg.Debug, "Serve a JSON list of every served file at --files-path")
+	fs.StringVar(&cfg.FilesPath, "files-path", cfg.FilesPath, "Path of the --debug file listing")
+
+	fs.BoolVar(&cfg.Quiet, "quiet", cfg.Quiet, "Only log warnings and errors")
+	fs.BoolVar(&cfg.Verbose, "verbose", cfg.Verbose, "Also log every served file and its encoding")
+	fs.BoolVar(&cfg.AccessLog, "access-log", cfg.AccessLog, "Log every request")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "Access log format: common, compact, or json")
+	fs.DurationVar((*time.Duration)(&cfg.SlowLog), "slow-log", time.Duration(cfg.SlowLog), "Log a warning for requests slower than this (0 disables)")
+	fs.StringVar(&cfg.LogFile, "log-file", cfg.LogFile, "Write logs to this file instead of stderr")
+	fs.IntVar(&cfg.LogMaxSize, "log-max-size", cfg.LogMaxSize, "Rotate --log-file once it reaches this many megabytes (0 disables rotation)")
+	fs.IntVar(&cfg.LogMaxBackups, "log-max-backups", cfg.LogMaxBackups, "Number of rotated log files to keep (0 keeps all)")
+
+	fs.DurationVar((*time.Duration)(&cfg.ReadTimeout), "read-timeout", time.Duration(cfg.ReadTimeout), "Maximum duration for reading a request (0 means no timeout)")
+	fs.DurationVar((*time.Duration)(&cfg.WriteTimeout), "write-timeout", time.Duration(cfg.WriteTimeout), "Maximum duration for writing a response (0 means no timeout)")
+	fs.DurationVar((*time.Duration)(&cfg.IdleTimeout), "idle-timeout", time.Duration(cfg.IdleTimeout), "Maximum time to keep idle keep-alive connections open (0 means no timeout)")
+	fs.BoolVar(&cfg.NoKeepAlive, "no-keepalive", cfg.NoKeepAlive, "Close the connection after every response")
+	fs.DurationVar((*time.Duration)(&cfg.ShutdownTimeout), "shutdown-timeout", time.Duration(cfg.ShutdownTimeout), "Time to wait for in-flight requests on shutdown")
+	fs.DurationVar((*time.Duration)(&cfg.PreShutdownDelay), "preshutdown-delay", time.Duration(cfg.PreShutdownDelay), "On SIGINT/SIGTERM, report unhealthy but keep serving this long before shutting down")
+
+	fs.StringVar(&cl.configFile, "config", cl.configFile, "Load settings from this JSON file")
+	fs.BoolVar(&cl.dumpConfig, "dump-config", cl.dumpConfig, "Print the effective configuration as JSON and exit")
+	fs.BoolVar(&cl.showVersion, "version", cl.showVersion, "Show version information")
+	fs.StringVar(&cl.verify, "verify", cl.verify, "Check the served files against this build.go manifest and exit")
+
+	// Customize help message
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Naidan Server - Static hosting for naidan\n\n")
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  naidan-server [options]\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fmt.Fprintf(os.Stderr, "  -p, --port int                          Port to listen on; 0 picks a free port (default 5536)\n")
+		fmt.Fprintf(os.Stderr, "      --port-retry int                    Try up to this many following ports if the port is in use (default 0)\n")
+		fmt.Fprintf(os.Stderr, "      --ports list                        Try these ports in order, e.g. 5536,5537,8080, and listen on the first available; replaces --port\n")
+		fmt.Fprintf(os.Stderr, "      --host string                       Host or interface to bind to, e.g. 0.0.0.0 or [::1] (default localhost)\n")
+		fmt.Fprintf(os.Stderr, "      --unix path                         Listen on a Unix domain socket instead of TCP; --host and --port are ignored\n")
+		fmt.Fprintf(os.Stderr, "      --cert string                       TLS certificate file; enables HTTPS together with --key\n")
+		fmt.Fprintf(os.Stderr, "      --key string                        TLS private key file; enables HTTPS together with --cert\n")
+		fmt.Fprintf(os.Stderr, "      --self-signed                       Serve HTTPS with an in-memory self-signed certificate (valid for 24h)\n")
+		fmt.Fprintf(os.Stderr, "      --tls-min-version string            Minimum TLS version, 1.2 or 1.3 (default 1.2)\n")
+		fmt.Fprintf(os.Stderr, "      --tls-ciphers list                  TLS 1.2 cipher suites to allow, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256; TLS 1.3 suites are chosen by Go\n")
+		fmt.Fprintf(os.Stderr, "      --client-ca path                    Require TLS client certificates signed by a CA in this PEM bundle; others fail the handshake\n")
+		fmt.Fprintf(os.Stderr, "      --redirect-http int                 Also listen on this plain HTTP port and redirect every request to HTTPS\n")
+		fmt.Fprintf(os.Stderr, "      --h2c                               Also accept HTTP/2 without TLS (h2c with prior knowledge), e.g. from a proxy in front\n")
+		fmt.Fprintf(os.Stderr, "      --pid-file path                     Write the process ID to this file once listening; removed on shutdown\n")
+		fmt.Fprintf(os.Stderr, "      --user string                       Switch to this user (name or uid) once listening, e.g. to bind port 80 as root; Unix only\n")
+		fmt.Fprintf(os.Stderr, "      --group string                      Switch to this group (name or gid) once listening; defaults to the --user's group\n")
+		fmt.Fprintf(os.Stderr, "      --on-ready string                   Run this command, e.g. \"register.sh --port 5536\", once listening; its output is logged and NAIDAN_ADDR holds the address\n")
+		fmt.Fprintf(os.Stderr, "      --open                              Open the server URL in the default browser once listening\n")
+		fmt.Fprintf(os.Stderr, "      --dir string                        Serve files from this directory instead of the embedded assets\n")
+		fmt.Fprintf(os.Stderr, "      --zip path                          Serve files from this ZIP archive instead of the embedded assets\n")
+		fmt.Fprintf(os.Stderr, "      --base-path string                  Serve the files under this URL prefix, e.g. /naidan/; / redirects there. The front-end\n")
+		fmt.Fprintf(os.Stderr, "                                          must be built with the same base so asset URLs in index.html include it (default /)\n")
+		fmt.Fprintf(os.Stderr, "      --index string                      File served for directory requests, also used by --spa (default index.html)\n")
+		fmt.Fprintf(os.Stderr, "      --no-listing                        Answer 403 (or the --404-page) instead of listing directories without an index file\n")
+		fmt.Fprintf(os.Stderr, "      --allow-dotfiles                    Serve paths with a segment starting with a dot, e.g. /.env or /.git/config, which otherwise get 404\n")
+		fmt.Fprintf(os.Stderr, "                                          except under /.well-known/ (ACME challenges, security.txt). Such files often hold secrets,\n")
+		fmt.Fprintf(os.Stderr, "                                          credentials or repository history, so only enable this when every dotfile in --dir is public\n")
+		fmt.Fprintf(os.Stderr, "      --listing-template path             Render directory listings with this html/template file, read at startup; it gets .Path and\n")
+		fmt.Fprintf(os.Stderr, "                                          .Entries, each with .Name, .URL, .Size, .ModTime, and .IsDir\n")
+		fmt.Fprintf(os.Stderr, "      --i18n-index                        For directories, serve the index.<lang>.html (e.g. index.ja.html) best matching Accept-Language, else the index\n")
+		fmt.Fprintf(os.Stderr, "      --spa                               Serve the index file for unknown paths (client-side routing)\n")
+		fmt.Fprintf(os.Stderr, "      --clean-urls                        Serve /about from /about.html when /about doesn't exist\n")
+		fmt.Fprintf(os.Stderr, "      --clean-urls-redirect               With --clean-urls, redirect /about.html to /about with 301\n")
+		fmt.Fprintf(os.Stderr, "      --trailing-slash mode               keep leaves URLs as they are, add redirects /docs to /docs/, strip redirects /docs/ to /docs (default keep)\n")
+		fmt.Fprintf(os.Stderr, "      --rewrite value                     Serve /to for requests to /from without redirecting, given as /from=/to; /old/*=/new/* maps a prefix; repeatable\n")
+		fmt.Fprintf(os.Stderr, "      --redirect value                    Redirect /from to a path or URL, given as /from=to[=code]; code is 301 (default), 302, 303, 307, or 308; repeatable\n")
+		fmt.Fprintf(os.Stderr, "                                          Redirects are checked before rewrites, and the first matching rule of each wins\n")
+		fmt.Fprintf(os.Stderr, "      --default-robots                    Serve a built-in robots.txt that allows all crawlers when the served files have none\n")
+		fmt.Fprintf(os.Stderr, "      --default-favicon                   Serve a built-in favicon.ico when the served files have none\n")
+		fmt.Fprintf(os.Stderr, "      --404-page string                   HTML file (e.g. /404.html) among the served files returned with status 404\n")
+		fmt.Fprintf(os.Stderr, "      --live-reload                       With --dir, reload open pages when files change (injects a script into HTML)\n")
+		fmt.Fprintf(os.Stderr, "      --env-inject string                 Set KEY=VALUE in window.__ENV, injected in place of <!-- NAIDAN_ENV --> in the index file and its --i18n-index variants; repeatable\n")
+		fmt.Fprintf(os.Stderr, "      --mime string                       Override a Content-Type, e.g. .wasm=application/wasm; repeatable\n")
+		fmt.Fprintf(os.Stderr, "      --gzip-level int                    Gzip level for text assets, 1 (fastest) to 9 (smallest); 0 disables (default 6)\n")
+		fmt.Fprintf(os.Stderr, "      --br-quality int                    Brotli quality, preferred over gzip when the client accepts br, 1 (fastest) to 11 (smallest); 0 disables;\n")
+		fmt.Fprintf(os.Stderr, "                                          only in builds with -tags brotli; --brotli-level is an alias (default 4)\n")
+		fmt.Fprintf(os.Stderr, "                                          Both apply to on-the-fly compression only, not --precompressed files. Lower levels save CPU on busy\n")
+		fmt.Fprintf(os.Stderr, "                                          servers; higher ones save bandwidth, with Brotli above 9 costing far more CPU for little gain\n")
+		fmt.Fprintf(os.Stderr, "      --gzip-min-size size                Send responses smaller than this uncompressed, since gzip would barely shrink them (default 1KiB)\n")
+		fmt.Fprintf(os.Stderr, "      --precompressed                     Serve foo.js.br or foo.js.gz in place of foo.js when present and accepted\n")
+		fmt.Fprintf(os.Stderr, "      --etag                              Send SHA-256 based ETags and answer If-None-Match with 304 Not Modified\n")
+		fmt.Fprintf(os.Stderr, "      --cache-control string              Cache-Control for assets; HTML always gets no-cache, empty disables (default max-age=3600)\n")
+		fmt.Fprintf(os.Stderr, "      --cache-hash-pattern string         Regexp for content-hashed file names cached as immutable; empty disables (default [.-][0-9a-f]{8,}\\.)\n")
+		fmt.Fprintf(os.Stderr, "      --no-cache                          Send Cache-Control: no-store, must-revalidate, Pragma: no-cache, and Expires: 0 with everything; overrides --cache-control and --etag\n")
+		fmt.Fprintf(os.Stderr, "      --security-headers                  Send X-Content-Type-Options: nosniff, X-Frame-Options: DENY, and Referrer-Policy: no-referrer\n")
+		fmt.Fprintf(os.Stderr, "      --csp string                        Content-Security-Policy header sent with every response; empty omits it\n")
+		fmt.Fprintf(os.Stderr, "      --csp-nonce                         Replace __CSP_NONCE__ in --csp and in HTML pages, e.g. <script nonce=\"__CSP_NONCE__\">, with a fresh nonce per response\n")
+		fmt.Fprintf(os.Stderr, "      --header string                     Add a \"Name: Value\" header to every response, e.g. \"X-Robots-Tag: noindex\"; repeatable\n")
+		fmt.Fprintf(os.Stderr, "      --server-timing                     Send Server-Timing: app;dur=<ms> with the time taken until the response started\n")
+		fmt.Fprintf(os.Stderr, "      --server-header string              Set the Server response header; an empty value removes it (default: unchanged)\n")
+		fmt.Fprintf(os.Stderr, "      --allow-methods list                Also accept these methods, e.g. POST,PUT; others besides GET, HEAD, and OPTIONS get 405\n")
+		fmt.Fprintf(os.Stderr, "      --proxy value                       Forward requests under a prefix to a backend, given as /api=http://localhost:8080; repeatable\n")
+		fmt.Fprintf(os.Stderr, "      --proxy-strip                       Send /api/users to the backend as /users instead of /api/users\n")
+		fmt.Fprintf(os.Stderr, "      --max-body-size size                Reject request bodies larger than this, e.g. 512KiB or 10MB, with 413; 0 means no limit (default 10MiB)\n")
+		fmt.Fprintf(os.Stderr, "      --cors-origin string                Allow cross-origin requests from this origin, or * for any; repeatable\n")
+		fmt.Fprintf(os.Stderr, "      --basic-auth user:pass              Require HTTP Basic credentials; repeat for multiple users (health endpoint is exempt)\n")
+		fmt.Fprintf(os.Stderr, "      --allow-ip string                   Only allow clients in this CIDR range or IP, e.g. 192.168.0.0/16; repeatable\n")
+		fmt.Fprintf(os.Stderr, "      --deny-ip string                    Reject clients in this CIDR range or IP with 403; repeatable\n")
+		fmt.Fprintf(os.Stderr, "      --rate-limit float                  Maximum requests per second per client IP, answered with 429 when exceeded; 0 disables\n")
+		fmt.Fprintf(os.Stderr, "      --rate-burst int                    Requests a client may make in a burst (default: the rate, at least 1)\n")
+		fmt.Fprintf(os.Stderr, "      --max-connections int               Maximum requests handled at once; others get 503 (health, metrics, and live reload are exempt); 0 means no limit\n")
+		fmt.Fprintf(os.Stderr, "      --max-connections-wait duration     How long a request over --max-connections waits for a free slot; 0 rejects immediately\n")
+		fmt.Fprintf(os.Stderr, "      --trust-proxy                       Take the client IP from X-Forwarded-For or X-Real-IP; only enable behind a proxy that sets it\n")
+		fmt.Fprintf(os.Stderr, "      --trusted-proxy list                Like --trust-proxy, but only for peers in these CIDR ranges, e.g. 10.0.0.0/8; repeatable\n")
+		fmt.Fprintf(os.Stderr, "      --maintenance                       Start in maintenance mode: every request gets 503; SIGUSR1 toggles it on Unix\n")
+		fmt.Fprintf(os.Stderr, "      --maintenance-page path             HTML file served in maintenance mode (default: a built-in page)\n")
+		fmt.Fprintf(os.Stderr, "      --maintenance-retry-after duration  Retry-After sent in maintenance mode; 0 omits it (default 5m)\n")
+		fmt.Fprintf(os.Stderr, "      --maintenance-health-ok             Keep answering the health endpoint with 200 in maintenance mode\n")
+		fmt.Fprintf(os.Stderr, "      --health-path string                Path of the JSON health-check endpoint; empty disables (default /healthz)\n")
+		fmt.Fprintf(os.Stderr, "      --version-path string               Path of the JSON version endpoint; empty disables (default /__version)\n")
+		fmt.Fprintf(os.Stderr, "      --metrics-path string               Path of the Prometheus metrics endpoint, e.g. /metrics; empty disables (default empty)\n")
+		fmt.Fprintf(os.Stderr, "      --debug                             Serve a JSON list of every served file and its size at --files-path; exposes the site's layout, so not for production\n")
+		fmt.Fprintf(os.Stderr, "      --files-path string                 Path of the --debug file listing (default /__files)\n")
+		fmt.Fprintf(os.Stderr, "      --quiet                             Only log warnings and errors; the access log is still written if enabled\n")
+		fmt.Fprintf(os.Stderr, "      --verbose                           Also log the file served for each request and its Content-Encoding\n")
+		fmt.Fprintf(os.Stderr, "      --access-log                        Log every request to stderr, or to --log-file\n")
+		fmt.Fprintf(os.Stderr, "      --log-format string                 Access log format: common (Common Log Format), compact, or json (default common)\n")
+		fmt.Fprintf(os.Stderr, "      --slow-log duration                 Warn about requests that take longer than this, e.g. 500ms, even without --access-log; 0 disables\n")
+		fmt.Fprintf(os.Stderr, "      --log-file path                     Write logs to this file instead of stderr\n")
+		fmt.Fprintf(os.Stderr, "      --log-max-size int                  Rotate --log-file to a timestamped backup, e.g. naidan-2026-01-02T15-04-05.000.log, once it reaches this many MB; 0 disables (default 100)\n")
+		fmt.Fprintf(os.Stderr, "      --log-max-backups int               Number of rotated log files to keep; older ones are deleted; 0 keeps all\n")
+		fmt.Fprintf(os.Stderr, "      --read-timeout duration             Maximum time to read a request, including the body; 0 means no timeout (default 15s)\n")
+		fmt.Fprintf(os.Stderr, "      --write-timeout duration            Maximum time to write a response; 0 means no timeout (default 15s)\n")
+		fmt.Fprintf(os.Stderr, "      --idle-timeout duration             Maximum time an idle keep-alive connection stays open; 0 means no timeout (default 60s)\n")
+		fmt.Fprintf(os.Stderr, "      --no-keepalive                      Close the connection after every response, sending Connection: close\n")
+		fmt.Fprintf(os.Stderr, "      --shutdown-timeout duration         Time to wait for in-flight requests on SIGINT/SIGTERM (default 10s)\n")
+		fmt.Fprintf(os.Stderr, "      --preshutdown-delay duration        On SIGINT/SIGTERM, answer the health endpoint with 503 but keep serving requests this long, so load balancers drain traffic first; 0 shuts down at once\n")
+		fmt.Fprintf(os.Stderr, "      --config path                       Load settings from a JSON file; command-line flags take precedence over it\n")
+		fmt.Fprintf(os.Stderr, "      --dump-config                       Print the effective configuration as JSON, with passwords masked, and exit\n")
+		fmt.Fprintf(os.Stderr, "      --version                           Show version information\n")
+		fmt.Fprintf(os.Stderr, "      --verify path                       Check the embedded files (or --dir, --zip) against a SHA-256 manifest from build.go --manifest, list differences, and exit; exits 1 on any\n")
+		fmt.Fprintf(os.Stderr, "  -h, --help                              Show this help message\n\n")
+		fmt.Fprintf(os.Stderr, "Environment:\n")
+		fmt.Fprintf(os.Stderr, "  Every option except --version can also be set with a NAIDAN_ variable, e.g. NAIDAN_PORT or\n")
+		fmt.Fprintf(os.Stderr, "  NAIDAN_CACHE_CONTROL; repeatable options take a comma-separated list. Flags take precedence.\n")
+		fmt.Fprintf(os.Stderr, "  Under systemd socket activation (LISTEN_FDS, Unix only), the passed socket replaces --host,\n")
+		fmt.Fprintf(os.Stderr, "  --port, and --unix.\n")
+	}
+	return fs
+}
+
+// loadConfig resolves the configuration from args. Command-line flags take
+// precedence over NAIDAN_* environment variables, which take precedence over
+// the -config file, which takes precedence over the defaults.
+func loadConfig(args []string) (config, commandLine, error) {
+	cfg := defaultConfig()
+	var cl commandLine
+	fs := newFlagSet(&cfg, &cl)
+	fs.Parse(args)
+	cl.set = make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { cl.set[f.Name] = true })
+	if !cl.set["config"] {
+		cl.configFile = os.Getenv(envName("config"))
+	}
+	if cl.configFile != "" {
+		// Parse the flags again on top of the file so that they override it
+		cfg = defaultConfig()
+		if err := readConfigFile(cl.configFile, &cfg); err != nil {
+			return config{}, cl, err
+		}
+		fs = newFlagSet(&cfg, &cl)
+		fs.Parse(args)
+	}
+	if err := applyEnv(fs, cl.set); err != nil {
+		return config{}, cl, err
+	}
+	return cfg, cl, nil
+}
+
+// envName returns the environment variable for the flag name, e.g.
+// NAIDAN_CACHE_CONTROL for cache-control.
+func envName(name string) string {
+	return "NAIDAN_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets every flag of fs that is not in set from its environment
+// variable, if present. Repeatable flags take a comma-separated list.
+func applyEnv(fs *flag.FlagSet, set map[string]bool) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "p", "config", "dump-config", "version":
+			return
+		case "port":
+			if set["p"] {
+				return
+			}
+		case "br-quality", "brotli-level":
+			if set["br-quality"] || set["brotli-level"] {
+				return
+			}
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		values := []string{value}
+		if _, isList := f.Value.(*listFlag); isList {
+			values = strings.Split(value, ",")
+		}
+		for _, v := range values {
+			if e := f.Value.Set(strings.TrimSpace(v)); e != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", value, envName(f.Name), e)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// dumpConfig writes cfg as indented JSON that -config accepts, with the
+// passwords of -basic-auth masked.
+func dumpConfig(w io.Writer, cfg config) error {
+	cfg.BasicAuth = slices.Clone(cfg.BasicAuth)
+	for i, cred := range cfg.BasicAuth {
+		if user, _, ok := strings.Cut(cred, ":"); ok {
+			cfg.BasicAuth[i] = user + ":********"
+		}
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// readConfigFile decodes the JSON file at path into cfg. Unknown keys are
+// reported as errors so that typos don't go unnoticed.
+func readConfigFile(path string, cfg *config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	if dec.More() {
+		return fmt.Errorf("parse config file %s: unexpected data after the top-level object", path)
+	}
+	return nil
+}
+
+// byteSize is a number of bytes written with an optional unit, like "10MB"
+// or "512KiB", both on the command line and in JSON.
+type byteSize int64
+
+// byteUnits are the accepted byteSize suffixes, longest first.
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+func parseByteSize(s string) (byteSize, error) {
+	s = strings.TrimSpace(s)
+	unit := int64(1)
+	for _, u := range byteUnits {
+		if n, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, unit = strings.TrimSpace(n), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return byteSize(n * unit), nil
+}
+
+func (b byteSize) String() string {
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	v, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+func (b *byteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = byteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("size must be a number of bytes or a string like \"10MB\"")
+	}
+	return b.Set(s)
+}
+
+// duration is a time.Duration written as a string like "15s" in JSON.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"15s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// listFlag is a flag.Value for repeatable flags. The first occurrence on the
+// command line replaces the list from the defaults or a config file; later
+// occurrences append to it.
+type listFlag struct {
+	values *[]string
+	set    bool
+}
+
+func newListFlag(values *[]string) *listFlag {
+	return &listFlag{values: values}
+}
+
+func (f *listFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(*f.values, ", ")
+}
+
+func (f *listFlag) Set(value string) error {
+	if !f.set {
+		*f.values = nil
+		f.set = true
+	}
+	*f.values = append(*f.values, value)
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// corsHandler adds CORS headers for the allowed origins and answers
+// preflight requests, advertising methods as allowed. An allowed origin of
+// "*" permits every origin; otherwise the matching request origin is echoed
+// back. Plain OPTIONS requests are left to next.
+func corsHandler(allowedOrigins, methods []string, next http.Handler) http.Handler {
+	allowAny := slices.Contains(allowedOrigins, "*")
+	allowMethods := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		h := w.Header()
+		if !allowAny {
+			addVary(h, "Origin")
+		}
+		if origin == "" || (!allowAny && !slices.Contains(allowedOrigins, origin)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if allowAny {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		h.Set("Access-Control-Allow-Methods", allowMethods)
+		h.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Range")
+		h.Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, ETag")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				h.Set("Access-Control-Allow-Headers", requested)
+			}
+			if r.Header.Get("Access-Control-Request-Private-Network") == "true" {
+				h.Set("Access-Control-Allow-Private-Network", "true")
+			}
+			h.Set("Access-Control-Max-Age", "600")
+			h.Set("Allow", allowMethods)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
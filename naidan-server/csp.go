@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// cspNoncePlaceholder is replaced with the per-response nonce in the --csp
+// policy and in HTML pages, e.g. <script nonce="__CSP_NONCE__">.
+const cspNoncePlaceholder = "__CSP_NONCE__"
+
+// newNonce returns 128 random bits, base64 encoded.
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// cspNonceHandler sends policy as the Content-Security-Policy with a fresh
+// nonce in place of cspNoncePlaceholder, and puts the same nonce in place of
+// the placeholder in HTML pages. Since each page is only valid with its own
+// header, pages are marked as not to be stored and carry no validators.
+func cspNonceHandler(policy string, next http.Handler) http.Handler {
+	placeholder := []byte(cspNoncePlaceholder)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := newNonce()
+		w.Header().Set("Content-Security-Policy", strings.ReplaceAll(policy, cspNoncePlaceholder, nonce))
+		iw := &injectResponseWriter{ResponseWriter: w}
+		iw.rewrite = func(page []byte) []byte {
+			h := w.Header()
+			h.Set("Cache-Control", "no-store")
+			h.Del("Last-Modified")
+			return bytes.ReplaceAll(page, placeholder, []byte(nonce))
+		}
+		next.ServeHTTP(iw, r)
+		iw.finish()
+	})
+}
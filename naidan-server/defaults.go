@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"net/http"
+	"path"
+	"time"
+)
+
+//go:embed defaults
+var defaultFiles embed.FS
+
+// startTime is reported as the modification time of the built-in files.
+var startTime = time.Now()
+
+// defaultFileHandler serves the built-in file name from the defaults
+// directory for requests to /name when root has no such file, so bare
+// deployments don't answer crawlers and browsers with 404s. A real file in
+// root always takes precedence.
+func defaultFileHandler(root http.FileSystem, name string, next http.Handler) http.Handler {
+	data, err := defaultFiles.ReadFile(path.Join("defaults", name))
+	if err != nil {
+		panic(err)
+	}
+	urlPath := "/" + name
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != urlPath || fileExists(root, urlPath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.ServeContent(w, r, name, startTime, bytes.NewReader(data))
+	})
+}
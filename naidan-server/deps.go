@@ -0,0 +1,7 @@
+//go:build tools
+
+// Dependencies of build.go, which go mod tidy would drop because the ignore
+// build tag hides build.go from it.
+package main
+
+import _ "github.com/fsnotify/fsnotify"
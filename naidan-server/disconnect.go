@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// isClientGone reports whether err, from writing a response, means the
+// client went away: it canceled the request or closed or reset the
+// connection, as browsers do when a download is aborted.
+func isClientGone(err error) bool {
+	return errors.Is(err, context.Canceled) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// disconnectHandler notes the first error writing the response of next.
+// Clients that went away are only logged with --verbose, and counted by
+// stats if it isn't nil; other write errors are logged as warnings.
+func disconnectHandler(logger *leveledLogger, stats *metrics, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dw := &disconnectWriter{ResponseWriter: w}
+		next.ServeHTTP(dw, r)
+		err := dw.err
+		if err == nil {
+			// Handlers such as the proxy stop without writing once the
+			// request is canceled.
+			err = r.Context().Err()
+		}
+		switch {
+		case err == nil:
+		case isClientGone(err):
+			logger.Debugf("Client disconnected during %s %s: %v\n", r.Method, r.RequestURI, err)
+			if stats != nil {
+				stats.disconnects.Add(1)
+			}
+		default:
+			logger.Printf("Warning: writing the response to %s %s failed: %v\n", r.Method, r.RequestURI, err)
+		}
+	})
+}
+
+// disconnectWriter records the first error returned by Write or Flush.
+type disconnectWriter struct {
+	http.ResponseWriter
+	err error
+}
+
+func (w *disconnectWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *disconnectWriter) FlushError() error {
+	err := http.NewResponseController(w.ResponseWriter).Flush()
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return err
+}
+
+func (w *disconnectWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// healthHandler answers liveness probes, reporting 503 once stopping is set
+// so load balancers stop sending traffic before and during shutdown.
+func healthHandler(stopping *atomic.Bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if stopping.Load() {
+			w.Header().Set("Connection", "close")
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+}
+
+// drainHandler answers requests with 503 and closes their connection once
+// draining is set, instead of serving them while the server shuts down.
+// Paths in skip (such as the health endpoint) are left to next.
+func drainHandler(draining *atomic.Bool, skip map[string]bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() && !skip[r.URL.Path] {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "503 service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// versionInfo is the body served by versionHandler.
+type versionInfo struct {
+	Version       string            `json:"version"`
+	Commit        string            `json:"commit"`
+	BuildTime     string            `json:"buildTime"`
+	Modified      bool              `json:"modified,omitempty"`
+	GoVersion     string            `json:"goVersion"`
+	BuildSettings map[string]string `json:"buildSettings,omitempty"`
+}
+
+// versionHandler reports the server version and how the binary was built.
+func versionHandler() http.Handler {
+	info := versionInfo{Version: version, Commit: commit, BuildTime: buildTime, Modified: modified, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.BuildSettings = map[string]string{}
+		for _, s := range bi.Settings {
+			info.BuildSettings[s.Key] = s.Value
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, info)
+	})
+}
+
+// fileEntry is one file in the body served by filesHandler.
+type fileEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// filesHandler lists every file under root with its size, to help find out
+// why a file isn't served. It is only registered with --debug.
+func filesHandler(root http.FileSystem) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		files := []fileEntry{}
+		if err := listFiles(root, "/", &files); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		slices.SortFunc(files, func(a, b fileEntry) int { return strings.Compare(a.Path, b.Path) })
+		writeJSON(w, http.StatusOK, files)
+	})
+}
+
+// listFiles appends the regular files under dir in root to files.
+func listFiles(root http.FileSystem, dir string, files *[]fileEntry) error {
+	f, err := root.Open(dir)
+	if err != nil {
+		return err
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		switch {
+		case info.IsDir():
+			if err := listFiles(root, name, files); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			*files = append(*files, fileEntry{Path: name, Size: info.Size()})
+		}
+	}
+	return nil
+}
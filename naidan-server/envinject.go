@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// envPlaceholder is replaced with the -env-inject script in the index file.
+const envPlaceholder = "<!-- NAIDAN_ENV -->"
+
+// parseEnvInject parses KEY=VALUE entries of the -env-inject flag into the
+// script that defines window.__ENV.
+func parseEnvInject(entries []string) ([]byte, error) {
+	env := make(map[string]string)
+	for _, entry := range entries {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%q is not of the form KEY=VALUE", entry)
+		}
+		env[key] = value
+	}
+	// json.Marshal escapes <, >, and &, so values can't close the script
+	data, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return []byte("<script>window.__ENV=" + string(data) + "</script>"), nil
+}
+
+// envInjectEntry is a rewritten index file together with the file metadata
+// it was produced from.
+type envInjectEntry struct {
+	modTime time.Time
+	size    int64
+	body    []byte
+}
+
+// envInjectHandler serves the index file, and its index.<lang>.html variants
+// picked by --i18n-index, with envPlaceholder replaced by script. Rewritten
+// files are cached until they change on disk; files without the placeholder
+// are left to next.
+func envInjectHandler(root http.FileSystem, index string, script []byte, next http.Handler) http.Handler {
+	var cache sync.Map
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") {
+			name = path.Join(name, index)
+		} else if _, ok := indexLanguage(path.Base(name), index); !ok && (path.Base(name) != index || index == "index.html") {
+			// The file server redirects /index.html to the directory
+			next.ServeHTTP(w, r)
+			return
+		}
+		e, ok := injectedFile(root, name, script, &cache)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.ServeContent(w, r, name, e.modTime, bytes.NewReader(e.body))
+	})
+}
+
+// injectedFile returns name from root with the placeholder replaced, reading
+// it unless cache holds an entry for the same modification time and size.
+func injectedFile(root http.FileSystem, name string, script []byte, cache *sync.Map) (envInjectEntry, bool) {
+	f, err := root.Open(name)
+	if err != nil {
+		return envInjectEntry{}, false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return envInjectEntry{}, false
+	}
+	if v, ok := cache.Load(name); ok {
+		if e := v.(envInjectEntry); e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+			return e, e.body != nil
+		}
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return envInjectEntry{}, false
+	}
+	e := envInjectEntry{modTime: info.ModTime(), size: info.Size()}
+	if bytes.Contains(data, []byte(envPlaceholder)) {
+		e.body = bytes.Replace(data, []byte(envPlaceholder), script, 1)
+	}
+	cache.Store(name, e)
+	return e, e.body != nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// etagEntry is a cached ETag together with the file metadata it was computed
+// for, so files changed on disk under -dir are rehashed.
+type etagEntry struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+// etagHandler sets a strong, content-based ETag on files served from root.
+// The wrapped file server then answers If-None-Match with 304 Not Modified.
+// Requests for a directory are tagged with its index file, which the file
+// server serves for them.
+func etagHandler(root http.FileSystem, index string, next http.Handler) http.Handler {
+	var cache sync.Map
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			name := path.Clean("/" + r.URL.Path)
+			if strings.HasSuffix(r.URL.Path, "/") {
+				name = path.Join(name, index)
+			}
+			if etag, ok := fileETag(root, name, &cache); ok {
+				w.Header().Set("ETag", etag)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fileETag returns the ETag for name, hashing the file unless cache holds an
+// entry for the same modification time and size.
+func fileETag(root http.FileSystem, name string, cache *sync.Map) (string, bool) {
+	f, err := root.Open(name)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return "", false
+	}
+	if v, ok := cache.Load(name); ok {
+		if e := v.(etagEntry); e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+			return e.etag, true
+		}
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", false
+	}
+	etag := `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+	cache.Store(name, etagEntry{modTime: info.ModTime(), size: info.Size(), etag: etag})
+	return etag, true
+}
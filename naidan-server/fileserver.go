@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spaFallback serves the root index for paths that don't resolve to a
+// file, so client-side routes like /settings load the app. Paths that look
+// like assets (they have an extension) are passed through and still 404.
+// The rewritten request for "/" is resolved to the configured index file by
+// indexHandler further down the chain.
+func spaFallback(root http.FileSystem, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if path.Ext(name) == "" && !fileExists(root, name) {
+			r = withPath(r, "/")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// indexHandler serves the file named index for requests to a directory,
+// instead of the index.html the file server looks for.
+func indexHandler(root http.FileSystem, index string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			name := path.Join(path.Clean("/"+r.URL.Path), index)
+			if isRegularFile(root, name) {
+				r = withPath(r, name)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// noListingHandler answers requests for directories without an index file
+// with status instead of letting the file server list their contents.
+func noListingHandler(root http.FileSystem, index string, status int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if isDir(root, name) && !isRegularFile(root, path.Join(name, index)) {
+			http.Error(w, fmt.Sprintf("%d %s", status, strings.ToLower(http.StatusText(status))), status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// dotfileHandler answers 404 for paths with a segment starting with a dot,
+// such as /.env or /.git/config, except those under /.well-known/, which
+// ACME challenges and security.txt rely on. Dot entries in a served
+// directory are often left there by accident and may hold secrets.
+func dotfileHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isDotfilePath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isDotfilePath reports whether dotfileHandler hides p.
+func isDotfilePath(p string) bool {
+	segments := strings.Split(path.Clean("/"+p), "/")[1:]
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ".") && !(i == 0 && segment == ".well-known") {
+			return true
+		}
+	}
+	return false
+}
+
+// dotfileFS hides the files dotfileHandler doesn't serve, so directory
+// listings don't show their names either.
+type dotfileFS struct {
+	http.FileSystem
+}
+
+func (fsys dotfileFS) Open(name string) (http.File, error) {
+	if isDotfilePath(name) {
+		return nil, fs.ErrNotExist
+	}
+	f, err := fsys.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return dotfileDir{File: f, name: name}, nil
+}
+
+type dotfileDir struct {
+	http.File
+	name string
+}
+
+func (d dotfileDir) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	return slices.DeleteFunc(infos, func(info fs.FileInfo) bool {
+		return isDotfilePath(path.Join(d.name, info.Name()))
+	}), err
+}
+
+// notFoundPage replaces the plain-text body of 404 responses with the HTML
+// page at name in root. If the page can't be read, the default body is kept
+// and a warning is logged once.
+func notFoundPage(root http.FileSystem, name string, logger *log.Logger, next http.Handler) http.Handler {
+	var warnOnce sync.Once
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nw := &notFoundWriter{ResponseWriter: w}
+		next.ServeHTTP(nw, r)
+		if !nw.intercepted {
+			return
+		}
+		body, err := readFile(root, name)
+		if err != nil {
+			warnOnce.Do(func() {
+				logger.Printf("Warning: 404 page %s is not available, using the default response: %v\n", name, err)
+			})
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != http.MethodHead {
+			w.Write(body)
+		}
+	})
+}
+
+// notFoundWriter holds back plain-text 404 responses so notFoundPage can
+// write its own body instead.
+type notFoundWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	intercepted bool
+}
+
+func (w *notFoundWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusNotFound && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.intercepted = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *notFoundWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.intercepted {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *notFoundWriter) Flush() {
+	if !w.intercepted {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+func (w *notFoundWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// readFile returns the contents of the regular file name in root.
+func readFile(root http.FileSystem, name string) ([]byte, error) {
+	f, err := root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+	return io.ReadAll(f)
+}
+
+// cleanURLHandler serves /about from /about.html when /about doesn't exist.
+// With redirect set, requests for /about.html are permanently redirected to
+// /about so each page has one canonical URL.
+func cleanURLHandler(root http.FileSystem, index string, redirect bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/") || name == "/":
+		case path.Ext(name) == "" && !fileExists(root, name) && isRegularFile(root, name+".html"):
+			r = withPath(r, name+".html")
+		case redirect && path.Ext(name) == ".html" && path.Base(name) != index && isRegularFile(root, name):
+			localRedirect(w, r, "./"+strings.TrimSuffix(path.Base(name), ".html"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Trailing slash policies accepted by --trailing-slash.
+const (
+	trailingSlashKeep  = "keep"
+	trailingSlashAdd   = "add"
+	trailingSlashStrip = "strip"
+)
+
+// trailingSlashHandler gives every page one canonical URL. With mode add,
+// directory-style paths (directories and paths without an extension that
+// aren't files) are redirected to end in a slash, and files requested with
+// one are redirected to drop it. With mode strip, every slash-terminated
+// path is redirected to drop it. Either way, the canonical form is then
+// rewritten to the one the rest of the chain expects, so the file server's
+// own directory redirects don't undo it.
+func trailingSlashHandler(root http.FileSystem, mode string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if name == "/" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		slash := strings.HasSuffix(r.URL.Path, "/")
+		base := path.Base(name)
+		switch mode {
+		case trailingSlashAdd:
+			file := isRegularFile(root, name)
+			switch {
+			case slash && file:
+				localRedirect(w, r, "../"+base)
+				return
+			case slash && !isDir(root, name):
+				// Let --clean-urls and --spa resolve /about/ as /about
+				r = withPath(r, name)
+			case !slash && !file && (path.Ext(name) == "" || isDir(root, name)):
+				localRedirect(w, r, "./"+base+"/")
+				return
+			}
+		case trailingSlashStrip:
+			switch {
+			case slash:
+				localRedirect(w, r, "../"+base)
+				return
+			case isDir(root, name):
+				r = withPath(r, name+"/")
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// localRedirect redirects to target relative to the request path, keeping
+// the query. Unlike http.Redirect, it doesn't resolve target against
+// r.URL.Path, which may have had a --base-path prefix stripped.
+func localRedirect(w http.ResponseWriter, r *http.Request, target string) {
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+// fileExists reports whether name can be opened in root.
+func fileExists(root http.FileSystem, name string) bool {
+	f, err := root.Open(name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// isRegularFile reports whether name exists in root and is not a directory.
+func isRegularFile(root http.FileSystem, name string) bool {
+	f, err := root.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	return err == nil && !info.IsDir()
+}
+
+// isDir reports whether name exists in root and is a directory.
+func isDir(root http.FileSystem, name string) bool {
+	f, err := root.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	return err == nil && info.IsDir()
+}
+
+// withPath returns a shallow copy of r whose URL path is replaced by p.
+func withPath(r *http.Request, p string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = p
+	r2.URL.RawPath = ""
+	return r2
+}
+
+// addMIMETypes registers ".ext=type/subtype" entries of the -mime flag with
+// the mime package, which the file server uses to pick Content-Type.
+func addMIMETypes(entries []string) error {
+	for _, entry := range entries {
+		ext, typ, ok := strings.Cut(entry, "=")
+		ext, typ = strings.TrimSpace(ext), strings.TrimSpace(typ)
+		if !ok || len(ext) < 2 || ext[0] != '.' || strings.ContainsAny(ext[1:], "./") {
+			return fmt.Errorf("%q is not of the form .ext=type/subtype", entry)
+		}
+		if mediaType, _, err := mime.ParseMediaType(typ); err != nil || !strings.Contains(mediaType, "/") {
+			return fmt.Errorf("%q has an invalid media type", entry)
+		}
+		if err := mime.AddExtensionType(ext, typ); err != nil {
+			return fmt.Errorf("%q: %w", entry, err)
+		}
+	}
+	return nil
+}
+
+// modTimeFS reports modTime for the files of an http.FileSystem that has no
+// modification times, like the embedded assets, so responses carry a
+// Last-Modified header and If-Modified-Since can be answered with 304.
+type modTimeFS struct {
+	http.FileSystem
+	modTime time.Time
+}
+
+func (fsys modTimeFS) Open(name string) (http.File, error) {
+	f, err := fsys.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return modTimeFile{File: f, modTime: fsys.modTime}, nil
+}
+
+type modTimeFile struct {
+	http.File
+	modTime time.Time
+}
+
+func (f modTimeFile) Stat() (fs.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil || !info.ModTime().IsZero() {
+		return info, err
+	}
+	return modTimeInfo{FileInfo: info, modTime: f.modTime}, nil
+}
+
+type modTimeInfo struct {
+	fs.FileInfo
+	modTime time.Time
+}
+
+func (i modTimeInfo) ModTime() time.Time {
+	return i.modTime
+}
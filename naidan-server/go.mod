@@ -1,3 +1,11 @@
 module naidan-server
 
-go 1.24
+go 1.24.0
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/fsnotify/fsnotify v1.10.1
+	golang.org/x/text v0.34.0
+)
+
+require golang.org/x/sys v0.13.0 // indirect
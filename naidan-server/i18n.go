@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// matchLanguage picks the available language that best serves the
+// Accept-Language header, by the rules of golang.org/x/text/language: "en-US"
+// matches "en", while "zh-Hant" and "zh-Hans" stay apart and "pt-BR" is
+// preferred to "pt" when both are there. Entries of available that aren't
+// valid language tags are ignored.
+func matchLanguage(header string, available []string) (string, bool) {
+	prefs, _, err := language.ParseAcceptLanguage(header)
+	if err != nil || len(prefs) == 0 {
+		return "", false
+	}
+	var tags []language.Tag
+	var langs []string
+	for _, lang := range available {
+		if tag, err := language.Parse(lang); err == nil {
+			tags = append(tags, tag)
+			langs = append(langs, lang)
+		}
+	}
+	if len(tags) == 0 {
+		return "", false
+	}
+	_, i, confidence := language.NewMatcher(tags).Match(prefs...)
+	if confidence == language.No {
+		return "", false
+	}
+	return langs[i], true
+}
+
+// localizedIndexes returns the languages of the index.<lang>.html variants
+// of index in dir, in directory order.
+func localizedIndexes(root http.FileSystem, dir, index string) []string {
+	f, err := root.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		return nil
+	}
+	var langs []string
+	for _, info := range infos {
+		if lang, ok := indexLanguage(info.Name(), index); ok && !info.IsDir() {
+			langs = append(langs, lang)
+		}
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// indexLanguage returns the language of the file name if it is an
+// index.<lang>.html variant of index.
+func indexLanguage(name, index string) (string, bool) {
+	ext := path.Ext(index)
+	lang, ok := strings.CutPrefix(name, strings.TrimSuffix(index, ext)+".")
+	if !ok {
+		return "", false
+	}
+	if lang, ok = strings.CutSuffix(lang, ext); !ok || lang == "" || strings.Contains(lang, ".") {
+		return "", false
+	}
+	return lang, true
+}
+
+// i18nIndexHandler serves the index.<lang>.html variant of the index file
+// that best matches the Accept-Language of requests for a directory, falling
+// back to the plain index file.
+func i18nIndexHandler(root http.FileSystem, index string, next http.Handler) http.Handler {
+	ext := path.Ext(index)
+	stem := strings.TrimSuffix(index, ext)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		dir := path.Clean("/" + r.URL.Path)
+		langs := localizedIndexes(root, dir, index)
+		if len(langs) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		addVary(w.Header(), "Accept-Language")
+		if lang, ok := matchLanguage(r.Header.Get("Accept-Language"), langs); ok {
+			w.Header().Set("Content-Language", lang)
+			r = withPath(r, path.Join(dir, stem+"."+lang+ext))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
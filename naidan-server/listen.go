@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenAddr joins host and port into an address for net.Listen.
+// The host may be a hostname, an IPv4 address, or an IPv6 address with or
+// without brackets (e.g. "[::1]").
+func listenAddr(host string, port int) (string, error) {
+	if host == "" {
+		return "", fmt.Errorf("host must not be empty (use 0.0.0.0 to listen on all interfaces)")
+	}
+	h := host
+	if strings.HasPrefix(h, "[") || strings.HasSuffix(h, "]") {
+		if !strings.HasPrefix(h, "[") || !strings.HasSuffix(h, "]") {
+			return "", fmt.Errorf("host %q has unbalanced brackets", host)
+		}
+		h = h[1 : len(h)-1]
+		if ip := net.ParseIP(h); ip == nil || ip.To4() != nil {
+			return "", fmt.Errorf("host %q is not a bracketed IPv6 address", host)
+		}
+	} else if strings.Contains(h, ":") && net.ParseIP(h) == nil {
+		return "", fmt.Errorf("host %q must not contain a port; use --port instead", host)
+	}
+	if port < 0 || port > 65535 {
+		return "", fmt.Errorf("port %d is out of range", port)
+	}
+	return net.JoinHostPort(h, strconv.Itoa(port)), nil
+}
+
+// listenTCP listens on host:port. If the port is already in use, up to
+// retries following ports are tried in turn.
+func listenTCP(host string, port, retries int, logger *leveledLogger) (net.Listener, error) {
+	for attempt := 0; ; attempt++ {
+		addr, err := listenAddr(host, port+attempt)
+		if err != nil {
+			return nil, err
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err == nil || port == 0 || attempt >= retries || !errors.Is(err, syscall.EADDRINUSE) {
+			return ln, err
+		}
+		logger.Infof("Port %d is in use, trying %d (attempt %d of %d)\n", port+attempt, port+attempt+1, attempt+1, retries)
+	}
+}
+
+// listenPorts listens on host at the first of ports that can be bound.
+func listenPorts(host string, ports []int, logger *leveledLogger) (net.Listener, error) {
+	var failures []string
+	for i, port := range ports {
+		addr, err := listenAddr(host, port)
+		if err != nil {
+			return nil, err
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err == nil {
+			if i > 0 {
+				logger.Infof("Bound port %d, alternative %d of --ports\n", port, i+1)
+			}
+			return ln, nil
+		}
+		logger.Infof("Cannot listen on port %d: %v\n", port, err)
+		failures = append(failures, strconv.Itoa(port))
+	}
+	return nil, fmt.Errorf("none of the ports %s could be bound", strings.Join(failures, ", "))
+}
+
+// parsePorts parses --ports entries, each a comma-separated list of ports.
+func parsePorts(entries []string) ([]int, error) {
+	var ports []int
+	for _, e := range entries {
+		for _, s := range strings.Split(e, ",") {
+			port, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("%q is not a port number", s)
+			}
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// browserURL returns a URL for reaching a TCP listener from this machine.
+// Wildcard binds are reached through localhost.
+func browserURL(scheme string, addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return scheme + "://" + addr.String() + "/"
+	}
+	host := tcpAddr.IP.String()
+	if tcpAddr.IP.IsUnspecified() {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(tcpAddr.Port)) + "/"
+}
+
+// lanURLs returns URLs for every non-loopback interface address when the
+// listener is bound to a wildcard address. Down interfaces and link-local
+// addresses are skipped since other machines generally can't use them.
+func lanURLs(scheme string, addr net.Addr) []string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || !tcpAddr.IP.IsUnspecified() {
+		return nil
+	}
+	ipv4Only := tcpAddr.IP.To4() != nil
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var urls []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipNet.IP
+			if ip.IsLoopback() || ip.IsLinkLocalUnicast() || (ipv4Only && ip.To4() == nil) {
+				continue
+			}
+			urls = append(urls, scheme+"://"+net.JoinHostPort(ip.String(), strconv.Itoa(tcpAddr.Port))+"/")
+		}
+	}
+	return urls
+}
+
+// listenUnix listens on a Unix domain socket at path, replacing a stale
+// socket file left behind by a previous run.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// newServer returns an http.Server for handler with the timeouts and
+// keep-alive setting of cfg, logging its errors to errorLog.
+func newServer(cfg config, handler http.Handler, errorLog *log.Logger) *http.Server {
+	srv := &http.Server{
+		Handler:      handler,
+		ErrorLog:     errorLog,
+		ReadTimeout:  time.Duration(cfg.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.WriteTimeout),
+		IdleTimeout:  time.Duration(cfg.IdleTimeout),
+	}
+	if cfg.NoKeepAlive {
+		// The server then answers HTTP/1.x requests with Connection: close
+		srv.SetKeepAlivesEnabled(false)
+	}
+	return srv
+}
+
+// serverProtocols returns the protocols the server accepts, or nil for the
+// defaults. With h2c, HTTP/2 is also accepted on plaintext connections from
+// clients that know to speak it, as proxies talking to an upstream do.
+func serverProtocols(h2c bool) *http.Protocols {
+	if !h2c {
+		return nil
+	}
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listingEntry is one directory entry passed to a --listing-template. URL
+// is the escaped link relative to the directory, ending in / for
+// directories.
+type listingEntry struct {
+	Name    string
+	URL     string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// listingData is the value a --listing-template is executed with. Path is
+// the directory's URL path, ending in /.
+type listingData struct {
+	Path    string
+	Entries []listingEntry
+}
+
+// loadListingTemplate parses the html/template at templatePath. It is read
+// once, so edits take effect on restart.
+func loadListingTemplate(templatePath string) (*template.Template, error) {
+	data, err := os.ReadFile(templatePath)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("listing").Parse(string(data))
+}
+
+// listingHandler renders tmpl for requests to directories without an index
+// file instead of the file server's own listing. html/template escapes the
+// entry names by context, so crafted file names can't inject markup.
+func listingHandler(root http.FileSystem, index string, tmpl *template.Template, logger *leveledLogger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		// Leave /dir to the file server, which redirects it to /dir/
+		if !strings.HasSuffix(r.URL.Path, "/") || !isDir(root, name) || isRegularFile(root, path.Join(name, index)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		entries, err := readListing(root, name)
+		if err != nil {
+			logger.Printf("Warning: cannot list %s: %v\n", name, err)
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, listingData{Path: r.URL.Path, Entries: entries}); err != nil {
+			logger.Printf("Warning: --listing-template failed for %s: %v\n", name, err)
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(buf.Bytes())
+		}
+	})
+}
+
+// readListing returns the entries of the directory name in root, sorted by
+// name like the file server's listing.
+func readListing(root http.FileSystem, name string) ([]listingEntry, error) {
+	dir, err := root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]listingEntry, 0, len(infos))
+	for _, info := range infos {
+		entry := listingEntry{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}
+		link := entry.Name
+		if entry.IsDir {
+			link += "/"
+			entry.Size = 0
+		}
+		// url.URL prefixes ./ when the name would otherwise read as a scheme
+		entry.URL = (&url.URL{Path: link}).String()
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(a, b listingEntry) int { return strings.Compare(a.Name, b.Name) })
+	return entries, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// liveReloadPath is the Server-Sent Events endpoint of -live-reload.
+const liveReloadPath = "/__livereload"
+
+// liveReloadPollInterval is how often the served directory is scanned.
+const liveReloadPollInterval = 500 * time.Millisecond
+
+// liveReloadScript reloads the page on change events. EventSource reconnects
+// on its own, e.g. across a server restart.
+const liveReloadScript = `<script>new EventSource("` + liveReloadPath + `").addEventListener("change", () => location.reload())</script>`
+
+// liveReload notifies connected browsers when files under a directory change.
+type liveReload struct {
+	mu      sync.Mutex
+	clients map[chan struct{}]bool
+	closed  bool
+	// done is closed by close to stop watch
+	done chan struct{}
+}
+
+func newLiveReload() *liveReload {
+	return &liveReload{clients: make(map[chan struct{}]bool), done: make(chan struct{})}
+}
+
+// watch polls dir until the live reload is closed and notifies the clients
+// whenever a file is added, removed, or modified.
+func (lr *liveReload) watch(dir string, logger *leveledLogger) {
+	last := dirSignature(dir)
+	ticker := time.NewTicker(liveReloadPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lr.done:
+			return
+		case <-ticker.C:
+		}
+		sig := dirSignature(dir)
+		if sig == last {
+			continue
+		}
+		last = sig
+		logger.Debugf("Files changed, reloading browsers\n")
+		lr.mu.Lock()
+		for c := range lr.clients {
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+		lr.mu.Unlock()
+	}
+}
+
+// dirSignature hashes the name, size, and modification time of every file
+// under dir.
+func dirSignature(dir string) uint64 {
+	h := fnv.New64a()
+	filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			fmt.Fprintf(h, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+		}
+		return nil
+	})
+	return h.Sum64()
+}
+
+// close ends every event stream so that shutdown doesn't wait for them.
+func (lr *liveReload) close() {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if lr.closed {
+		return
+	}
+	lr.closed = true
+	close(lr.done)
+	for c := range lr.clients {
+		close(c)
+		delete(lr.clients, c)
+	}
+}
+
+// handler streams a change event to the browser for every change.
+func (lr *liveReload) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := make(chan struct{}, 1)
+		lr.mu.Lock()
+		if lr.closed {
+			lr.mu.Unlock()
+			http.Error(w, "503 service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		lr.clients[c] = true
+		lr.mu.Unlock()
+		defer func() {
+			lr.mu.Lock()
+			delete(lr.clients, c)
+			lr.mu.Unlock()
+		}()
+
+		// The stream outlives --write-timeout
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+		for {
+			select {
+			case _, ok := <-c:
+				if !ok {
+					return
+				}
+				fmt.Fprintf(w, "event: change\ndata: reload\n\n")
+				rc.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
+
+// insertLiveReloadScript returns page with liveReloadScript inserted before
+// </body>, or at the end if there is none.
+func insertLiveReloadScript(page []byte) []byte {
+	i := bytes.LastIndex(bytes.ToLower(page), []byte("</body>"))
+	if i < 0 {
+		i = len(page)
+	}
+	return slices.Concat(page[:i], []byte(liveReloadScript), page[i:])
+}
+
+// liveReloadScriptHandler injects liveReloadScript into HTML pages served by
+// next, before </body> if there is one.
+func liveReloadScriptHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iw := &injectResponseWriter{ResponseWriter: w, rewrite: insertLiveReloadScript}
+		next.ServeHTTP(iw, r)
+		iw.finish()
+	})
+}
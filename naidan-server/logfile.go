@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat names rotated log files; it sorts chronologically.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile is an io.Writer appending to a log file. Once the file would
+// grow past maxSize bytes it is renamed to a timestamped backup and a new
+// one is started, keeping at most maxBackups backups (0 keeps all). Writes
+// are serialized, so a line never straddles two files.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// openRotatingFile opens path for appending, creating it if needed. A
+// maxSize of 0 disables rotation.
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the current file rather than dropping lines.
+			fmt.Fprintf(os.Stderr, "Failed to rotate %s: %v\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file to a backup and reopens path. It is
+// called with mu held, so no write happens between the two.
+func (f *rotatingFile) rotate() error {
+	ext := filepath.Ext(f.path)
+	var backup string
+	// Rotations within the same millisecond would share a name; move the
+	// later one forward so no backup is overwritten.
+	for t := time.Now(); ; t = t.Add(time.Millisecond) {
+		backup = strings.TrimSuffix(f.path, ext) + "-" + t.Format(backupTimeFormat) + ext
+		if _, err := os.Lstat(backup); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.path, backup); err != nil {
+		// Carry on appending to the file that couldn't be moved.
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.removeOldBackups()
+}
+
+// removeOldBackups deletes all but the newest maxBackups backups.
+func (f *rotatingFile) removeOldBackups() error {
+	if f.maxBackups <= 0 {
+		return nil
+	}
+	dir, base := filepath.Split(f.path)
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "-"
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, e := range entries {
+		stamp, hasPrefix := strings.CutPrefix(e.Name(), prefix)
+		stamp, hasExt := strings.CutSuffix(stamp, ext)
+		if !hasPrefix || !hasExt || !e.Type().IsRegular() {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, e.Name())
+		}
+	}
+	slices.Sort(backups)
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Close closes the current file.
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
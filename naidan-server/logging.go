@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Levels of leveledLogger, set by -quiet and -verbose.
+const (
+	levelQuiet = iota
+	levelNormal
+	levelVerbose
+)
+
+// leveledLogger is a log.Logger whose informational messages can be muted.
+// Printf and Fatalf always log; they are meant for warnings and errors.
+type leveledLogger struct {
+	*log.Logger
+	level int
+}
+
+func newLeveledLogger(out io.Writer, level int) *leveledLogger {
+	return &leveledLogger{Logger: log.New(out, "", log.LstdFlags), level: level}
+}
+
+// Infof logs unless the level is quiet.
+func (l *leveledLogger) Infof(format string, v ...any) {
+	if l.level >= levelNormal {
+		l.Printf(format, v...)
+	}
+}
+
+// Debugf logs only when the level is verbose.
+func (l *leveledLogger) Debugf(format string, v ...any) {
+	if l.level >= levelVerbose {
+		l.Printf(format, v...)
+	}
+}
+
+type servedFileKey struct{}
+
+// servedFileLogger logs the file served for each request handled by next and
+// the Content-Encoding it was sent with. The file is reported by
+// recordServedFile, which wraps the file server itself, so rewrites such as
+// the SPA fallback show up.
+func servedFileLogger(logger *leveledLogger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		ctx := context.WithValue(r.Context(), servedFileKey{}, &name)
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		encoding := w.Header().Get("Content-Encoding")
+		if encoding == "" {
+			encoding = "identity"
+		}
+		logger.Debugf("Served %s from %s (status %d, encoding %s)\n", r.URL.Path, name, rec.status, encoding)
+	})
+}
+
+// recordServedFile reports the path next serves to servedFileLogger.
+func recordServedFile(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name, ok := r.Context().Value(servedFileKey{}).(*string); ok {
+			*name = r.URL.Path
+		}
+		next.ServeHTTP(w, r)
+	})
+}
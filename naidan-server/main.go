@@ -1,62 +1,700 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"embed"
-	"flag"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"io/fs"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 //go:embed all:public
 var embeddedFiles embed.FS
 
-var version = "dev"
+// Set at build time with -ldflags "-X main.version=..." and friends
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
 
 func main() {
-	// Setup logger to stderr
-	logger := log.New(os.Stderr, "", log.LstdFlags)
-
-	// Define flags
-	var port int
-	// flag package supports both -name and --name automatically
-	flag.IntVar(&port, "port", 5536, "Port to listen on")
-	flag.IntVar(&port, "p", 5536, "Port to listen on (shorthand)")
-	showVersion := flag.Bool("version", false, "Show version information")
-
-	// Customize help message
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Naidan Server - Static hosting for naidan\n\n")
-		fmt.Fprintf(os.Stderr, "Usage:\n")
-		fmt.Fprintf(os.Stderr, "  naidan-server [options]\n\n")
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		fmt.Fprintf(os.Stderr, "  -p, --port int    Port to listen on (default 5536)\n")
-		fmt.Fprintf(os.Stderr, "      --version     Show version information\n")
-		fmt.Fprintf(os.Stderr, "  -h, --help        Show this help message\n")
-	}
-
-	flag.Parse()
-
-	if *showVersion {
-		fmt.Printf("naidan-server version %s\n", version)
+	cfg, cl, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v\n", err)
+	}
+	if cfg.Quiet && cfg.Verbose {
+		log.Fatalf("--quiet and --verbose cannot be combined\n")
+	}
+
+	// Setup logger to stderr or --log-file
+	level := levelNormal
+	if cfg.Quiet {
+		level = levelQuiet
+	} else if cfg.Verbose {
+		level = levelVerbose
+	}
+	var logOut io.Writer = os.Stderr
+	if cfg.LogFile != "" && !cl.dumpConfig && !cl.showVersion && cl.verify == "" {
+		if cfg.LogMaxSize < 0 || cfg.LogMaxBackups < 0 {
+			log.Fatalf("--log-max-size and --log-max-backups must not be negative\n")
+		}
+		logFile, err := openRotatingFile(cfg.LogFile, int64(cfg.LogMaxSize)<<20, cfg.LogMaxBackups)
+		if err != nil {
+			log.Fatalf("Failed to open --log-file: %v\n", err)
+		}
+		defer logFile.Close()
+		logOut = logFile
+	}
+	logger := newLeveledLogger(logOut, level)
+
+	if cl.dumpConfig {
+		if err := dumpConfig(os.Stdout, cfg); err != nil {
+			log.Fatalf("Failed to print configuration: %v\n", err)
+		}
+		return
+	}
+	if cl.showVersion {
+		fmt.Println(versionString())
 		return
 	}
 
-	// Strip the "public" prefix from the embedded filesystem
-	publicFS, err := fs.Sub(embeddedFiles, "public")
+	if (cfg.Cert == "") != (cfg.Key == "") {
+		logger.Fatalf("Both --cert and --key are required to enable TLS\n")
+	}
+	if cfg.SelfSigned && cfg.Cert != "" {
+		logger.Fatalf("--self-signed cannot be combined with --cert and --key\n")
+	}
+	useTLS := cfg.Cert != "" || cfg.SelfSigned
+	switch cfg.LogFormat {
+	case logFormatCommon, logFormatCompact, logFormatJSON:
+	default:
+		logger.Fatalf("Unknown --log-format %q (expected common, compact, or json)\n", cfg.LogFormat)
+	}
+	allowNets, err := parseCIDRs(cfg.AllowIPs)
+	if err != nil {
+		logger.Fatalf("Invalid --allow-ip: %v\n", err)
+	}
+	denyNets, err := parseCIDRs(cfg.DenyIPs)
+	if err != nil {
+		logger.Fatalf("Invalid --deny-ip: %v\n", err)
+	}
+	var proxyNets []*net.IPNet
+	if len(cfg.TrustedProxies) > 0 {
+		proxyNets, err = parseCIDRs(strings.Split(strings.Join(cfg.TrustedProxies, ","), ","))
+		if err != nil {
+			logger.Fatalf("Invalid --trusted-proxy: %v\n", err)
+		}
+	}
+	trusted := newTrustedProxies(cfg.TrustProxy, proxyNets)
+	if err := addMIMETypes(cfg.MIMETypes); err != nil {
+		logger.Fatalf("Invalid --mime: %v\n", err)
+	}
+	envScript, err := parseEnvInject(cfg.EnvInject)
+	if err != nil {
+		logger.Fatalf("Invalid --env-inject: %v\n", err)
+	}
+	customHeaders, err := parseHeaders(cfg.Headers)
+	if err != nil {
+		logger.Fatalf("Invalid --header: %v\n", err)
+	}
+	authCreds, err := parseBasicAuth(cfg.BasicAuth)
+	if err != nil {
+		logger.Fatalf("Invalid --basic-auth: %v\n", err)
+	}
+	basePrefix := normalizeBasePath(cfg.BasePath)
+	if cfg.Dir != "" && cfg.Zip != "" {
+		logger.Fatalf("--dir and --zip cannot be combined\n")
+	}
+	if cfg.LiveReload && cfg.Dir == "" {
+		logger.Fatalf("--live-reload requires --dir\n")
+	}
+	if cfg.CleanURLsRedirect && !cfg.CleanURLs {
+		logger.Fatalf("--clean-urls-redirect requires --clean-urls\n")
+	}
+	var listingTemplate *template.Template
+	if cfg.ListingTemplate != "" {
+		if cfg.NoListing {
+			logger.Fatalf("--listing-template and --no-listing cannot be combined\n")
+		}
+		var err error
+		if listingTemplate, err = loadListingTemplate(cfg.ListingTemplate); err != nil {
+			logger.Fatalf("Invalid --listing-template: %v\n", err)
+		}
+	}
+	switch cfg.TrailingSlash {
+	case trailingSlashKeep, trailingSlashAdd, trailingSlashStrip:
+	default:
+		logger.Fatalf("Unknown --trailing-slash %q (expected keep, add, or strip)\n", cfg.TrailingSlash)
+	}
+	if cfg.CSPNonce && !strings.Contains(cfg.CSP, cspNoncePlaceholder) {
+		logger.Fatalf("--csp-nonce requires a --csp policy containing %s, e.g. \"script-src 'nonce-%s'\"\n", cspNoncePlaceholder, cspNoncePlaceholder)
+	}
+	if cfg.Index == "" || strings.Contains(cfg.Index, "/") {
+		logger.Fatalf("--index must be a file name, got %q\n", cfg.Index)
+	}
+	if cfg.HealthPath != "" && !strings.HasPrefix(cfg.HealthPath, "/") {
+		logger.Fatalf("--health-path must start with /, got %q\n", cfg.HealthPath)
+	}
+	if cfg.VersionPath != "" && !strings.HasPrefix(cfg.VersionPath, "/") {
+		logger.Fatalf("--version-path must start with /, got %q\n", cfg.VersionPath)
+	}
+	if cfg.Debug && !strings.HasPrefix(cfg.FilesPath, "/") {
+		logger.Fatalf("--files-path must start with /, got %q\n", cfg.FilesPath)
+	}
+	if cfg.MetricsPath != "" && !strings.HasPrefix(cfg.MetricsPath, "/") {
+		logger.Fatalf("--metrics-path must start with /, got %q\n", cfg.MetricsPath)
+	}
+	if cfg.MaxConnections < 0 {
+		logger.Fatalf("--max-connections must not be negative, got %d\n", cfg.MaxConnections)
+	}
+	allowedMethods, err := parseAllowedMethods(cfg.AllowMethods)
+	if err != nil {
+		logger.Fatalf("Invalid --allow-methods: %v\n", err)
+	}
+	proxies, err := parseProxies(cfg.Proxies)
+	if err != nil {
+		logger.Fatalf("Invalid --proxy: %v\n", err)
+	}
+	rewrites, err := parseRewrites(cfg.Rewrites)
+	if err != nil {
+		logger.Fatalf("Invalid --rewrite: %v\n", err)
+	}
+	redirects, err := parseRedirects(cfg.Redirects)
+	if err != nil {
+		logger.Fatalf("Invalid --redirect: %v\n", err)
+	}
+	var hashedName *regexp.Regexp
+	if cfg.CacheHashPattern != "" {
+		re, err := regexp.Compile(cfg.CacheHashPattern)
+		if err != nil {
+			logger.Fatalf("Invalid --cache-hash-pattern: %v\n", err)
+		}
+		hashedName = re
+	}
+	if cfg.RedirectHTTP != 0 && !useTLS {
+		logger.Fatalf("--redirect-http requires TLS (--cert/--key or --self-signed)\n")
+	}
+	tlsMin, ok := tlsVersions[cfg.TLSMinVersion]
+	if !ok {
+		logger.Fatalf("Unknown --tls-min-version %q (expected 1.2 or 1.3)\n", cfg.TLSMinVersion)
+	}
+	cipherSuites, err := parseCipherSuites(cfg.TLSCiphers)
+	if err != nil {
+		logger.Fatalf("Invalid --tls-ciphers: %v\n", err)
+	}
+	if len(cipherSuites) > 0 && !useTLS {
+		logger.Fatalf("--tls-ciphers requires TLS (--cert/--key or --self-signed)\n")
+	}
+	if len(cipherSuites) > 0 && tlsMin == tls.VersionTLS13 {
+		logger.Printf("Warning: --tls-ciphers has no effect with --tls-min-version 1.3\n")
+	}
+	var clientCAs *x509.CertPool
+	if cfg.ClientCA != "" {
+		if !useTLS {
+			logger.Fatalf("--client-ca requires TLS (--cert/--key or --self-signed)\n")
+		}
+		// Read it now, before --user drops privileges
+		clientCAs, err = loadCertPool(cfg.ClientCA)
+		if err != nil {
+			logger.Fatalf("Invalid --client-ca: %v\n", err)
+		}
+	}
+	var readyHook []string
+	if cfg.OnReady != "" {
+		if readyHook, err = splitCommand(cfg.OnReady); err != nil {
+			logger.Fatalf("Invalid --on-ready: %v\n", err)
+		}
+	}
+	ports, err := parsePorts(cfg.Ports)
+	if err != nil {
+		logger.Fatalf("Invalid --ports: %v\n", err)
+	}
+	if len(ports) > 0 && (cl.set["port"] || cl.set["p"] || cfg.Port != defaultConfig().Port) {
+		logger.Fatalf("--port and --ports cannot be combined\n")
+	}
+	if len(ports) > 0 && cfg.PortRetry != 0 {
+		logger.Fatalf("--port-retry and --ports cannot be combined\n")
+	}
+	if cfg.PortRetry < 0 {
+		logger.Fatalf("--port-retry must not be negative, got %d\n", cfg.PortRetry)
+	}
+	if cfg.RateLimit < 0 || cfg.RateBurst < 0 {
+		logger.Fatalf("--rate-limit and --rate-burst must not be negative\n")
+	}
+	if cfg.RateLimit > 0 && cfg.RateBurst == 0 {
+		cfg.RateBurst = max(1, int(math.Ceil(cfg.RateLimit)))
+	}
+	if cfg.GzipLevel < 0 || cfg.GzipLevel > 9 {
+		logger.Fatalf("--gzip-level must be between 0 and 9, got %d\n", cfg.GzipLevel)
+	}
+	if cfg.BrotliLevel < 0 || cfg.BrotliLevel > 11 {
+		logger.Fatalf("--br-quality must be between 0 and 11, got %d\n", cfg.BrotliLevel)
+	}
+	if (cl.set["br-quality"] || cl.set["brotli-level"]) && !brotliSupported {
+		logger.Printf("Warning: --br-quality has no effect, this build lacks Brotli support (build with -tags brotli)\n")
+	}
+
+	var root http.FileSystem
+	if cfg.Dir != "" {
+		if err := checkDir(cfg.Dir); err != nil {
+			logger.Fatalf("Cannot serve directory: %v\n", err)
+		}
+		root = http.Dir(cfg.Dir)
+		logger.Infof("Serving files from directory %s\n", cfg.Dir)
+	} else if cfg.Zip != "" {
+		zfs, err := openZipFS(cfg.Zip)
+		if err != nil {
+			logger.Fatalf("Cannot serve archive: %v\n", err)
+		}
+		root = http.FS(zfs)
+		logger.Infof("Serving files from archive %s\n", cfg.Zip)
+	} else {
+		// Strip the "public" prefix from the embedded filesystem
+		publicFS, err := fs.Sub(embeddedFiles, "public")
+		if err != nil {
+			logger.Fatalf("Critical error: Could not access embedded 'public' directory: %v\nEnsure 'public' exists inside 'naidan-server' directory when building.", err)
+		}
+		root = http.FS(publicFS)
+		// Embedded files have no modification time; use the build's, which
+		// stays the same until the next deploy
+		if t, err := time.Parse(time.RFC3339, buildTime); err == nil {
+			root = modTimeFS{FileSystem: root, modTime: t}
+		}
+	}
+
+	if cl.verify != "" {
+		problems, err := verifyManifest(root, cl.verify, os.Stdout)
+		if err != nil {
+			logger.Fatalf("Failed to verify files: %v\n", err)
+		}
+		if problems > 0 {
+			fmt.Printf("Found %d differences from %s\n", problems, cl.verify)
+			os.Exit(1)
+		}
+		fmt.Printf("All files match %s\n", cl.verify)
+		return
+	}
+
+	// Set once a shutdown signal arrives, and once requests stop being
+	// served, which is later with --preshutdown-delay
+	stopping, draining := new(atomic.Bool), new(atomic.Bool)
+	if cfg.HealthPath != "" {
+		http.Handle(cfg.HealthPath, healthHandler(stopping))
+	}
+	if cfg.VersionPath != "" {
+		http.Handle(cfg.VersionPath, versionHandler())
+	}
+	if cfg.Debug {
+		http.Handle(cfg.FilesPath, filesHandler(root))
+		logger.Printf("Warning: --debug lists every served file at %s\n", cfg.FilesPath)
+	}
+	for _, rule := range proxies {
+		http.Handle(rule.prefix+"/", rule.handler(cfg.ProxyStrip, logger))
+		logger.Infof("Proxying %s/ to %s\n", rule.prefix, rule.target)
+	}
+	var stats *metrics
+	if cfg.MetricsPath != "" {
+		stats = newMetrics()
+		http.Handle(cfg.MetricsPath, stats.handler())
+	}
+
+	// Handle all other requests with the static file server
+	// The file server and listings see the tree without the hidden dotfiles
+	fileRoot := root
+	if !cfg.AllowDotfiles {
+		fileRoot = dotfileFS{root}
+	}
+	var handler http.Handler = http.FileServer(fileRoot)
+	if cfg.Verbose {
+		handler = recordServedFile(handler)
+	}
+	if cfg.ETag && !cfg.NoCache {
+		handler = etagHandler(root, cfg.Index, handler)
+	}
+	if len(cfg.EnvInject) > 0 {
+		handler = envInjectHandler(root, cfg.Index, envScript, handler)
+	}
+	if cfg.NoListing {
+		// With a custom 404 page, hide directories entirely
+		status := http.StatusForbidden
+		if cfg.NotFoundPage != "" {
+			status = http.StatusNotFound
+		}
+		handler = noListingHandler(root, cfg.Index, status, handler)
+	}
+	if listingTemplate != nil {
+		handler = listingHandler(fileRoot, cfg.Index, listingTemplate, logger, handler)
+	}
+	if cfg.Index != "index.html" {
+		handler = indexHandler(root, cfg.Index, handler)
+	}
+	if cfg.I18nIndex {
+		handler = i18nIndexHandler(root, cfg.Index, handler)
+	}
+	if cfg.SPA {
+		handler = spaFallback(root, handler)
+	}
+	if cfg.CleanURLs {
+		handler = cleanURLHandler(root, cfg.Index, cfg.CleanURLsRedirect, handler)
+	}
+	if cfg.DefaultRobots {
+		handler = defaultFileHandler(root, "robots.txt", handler)
+	}
+	if cfg.DefaultFavicon {
+		handler = defaultFileHandler(root, "favicon.ico", handler)
+	}
+	if cfg.NotFoundPage != "" {
+		handler = notFoundPage(root, path.Clean("/"+cfg.NotFoundPage), logger.Logger, handler)
+	}
+	if cfg.CSPNonce {
+		handler = cspNonceHandler(cfg.CSP, handler)
+	}
+	if cfg.TrailingSlash != trailingSlashKeep {
+		handler = trailingSlashHandler(root, cfg.TrailingSlash, handler)
+	}
+	var lr *liveReload
+	if cfg.LiveReload {
+		lr = newLiveReload()
+		go lr.watch(cfg.Dir, logger)
+		http.Handle(liveReloadPath, lr.handler())
+		handler = liveReloadScriptHandler(handler)
+	}
+	if cfg.Precompressed {
+		handler = precompressedHandler(root, cfg.CSPNonce, handler)
+	}
+	if !cfg.NoCache {
+		handler = cacheControlHandler(cfg.CacheControl, hashedName, handler)
+	}
+	csp := cfg.CSP
+	if cfg.CSPNonce {
+		// cspNonceHandler sends the policy with the nonce filled in
+		csp = ""
+	}
+	if cfg.SecurityHeaders || csp != "" {
+		handler = securityHeadersHandler(cfg.SecurityHeaders, csp, handler)
+	}
+	if cfg.GzipLevel > 0 || (brotliSupported && cfg.BrotliLevel > 0) {
+		handler = compressHandler(cfg.GzipLevel, cfg.BrotliLevel, int(cfg.GzipMinSize), handler)
+	}
+	if !cfg.AllowDotfiles {
+		// Ahead of every handler that could tell a hidden file exists, such
+		// as the --trailing-slash redirects
+		handler = dotfileHandler(handler)
+		if cfg.NotFoundPage != "" {
+			handler = notFoundPage(root, path.Clean("/"+cfg.NotFoundPage), logger.Logger, handler)
+		}
+	}
+	if cfg.Verbose {
+		handler = servedFileLogger(logger, handler)
+	}
+	if basePrefix == "/" {
+		http.Handle("/", handler)
+	} else {
+		http.Handle(basePrefix, http.StripPrefix(strings.TrimSuffix(basePrefix, "/"), handler))
+		http.Handle("/{$}", http.RedirectHandler(basePrefix, http.StatusFound))
+	}
+
+	var rootHandler http.Handler = http.DefaultServeMux
+	if len(redirects) > 0 || len(rewrites) > 0 {
+		rootHandler = rewriteHandler(redirects, rewrites, rootHandler)
+	}
+	maint, err := newMaintenance(cfg.MaintenancePage, time.Duration(cfg.MaintenanceRetryAfter), logger)
 	if err != nil {
-		logger.Fatalf("Critical error: Could not access embedded 'public' directory: %v\nEnsure 'public' exists inside 'naidan-server' directory when building.", err)
+		logger.Fatalf("Cannot read --maintenance-page: %v\n", err)
+	}
+	maintenanceSkip := map[string]bool{}
+	if cfg.MaintenanceHealthOK {
+		maintenanceSkip[cfg.HealthPath] = true
+	}
+	rootHandler = maint.middleware(maintenanceSkip, rootHandler)
+	maint.set(cfg.Maintenance)
+	toggle := make(chan os.Signal, 1)
+	notifyMaintenanceToggle(toggle)
+	go func() {
+		for range toggle {
+			maint.toggle()
+		}
+	}()
+	if cfg.ServerTiming {
+		rootHandler = serverTimingHandler(rootHandler)
+	}
+	if cfg.NoCache {
+		rootHandler = noCacheHandler(rootHandler)
+	}
+	if len(customHeaders) > 0 {
+		rootHandler = customHeadersHandler(customHeaders, rootHandler)
+	}
+	if cfg.MaxBodySize > 0 {
+		rootHandler = maxBodyHandler(int64(cfg.MaxBodySize), rootHandler)
+	}
+	rootHandler = methodFilterHandler(allowedMethods, func(p string) bool { return proxied(proxies, p) }, rootHandler)
+	if len(authCreds) > 0 {
+		rootHandler = basicAuthHandler(authCreds, map[string]bool{cfg.HealthPath: true}, rootHandler)
+	}
+	if len(cfg.CORSOrigins) > 0 {
+		rootHandler = corsHandler(cfg.CORSOrigins, allowedMethods, rootHandler)
+	}
+	if len(allowNets) > 0 || len(denyNets) > 0 {
+		rootHandler = ipFilterHandler(allowNets, denyNets, trusted, rootHandler)
+	}
+	if cfg.RateLimit > 0 {
+		rootHandler = newRateLimiter(cfg.RateLimit, cfg.RateBurst).middleware(trusted, map[string]bool{cfg.HealthPath: true}, rootHandler)
+	}
+	if cfg.MaxConnections > 0 {
+		limiter := newConcurrencyLimiter(cfg.MaxConnections, time.Duration(cfg.MaxConnWait))
+		limiterSkip := map[string]bool{cfg.HealthPath: true, cfg.MetricsPath: true}
+		if cfg.LiveReload {
+			// Each open tab holds its event stream for as long as it is open
+			limiterSkip[liveReloadPath] = true
+		}
+		rootHandler = limiter.middleware(limiterSkip, rootHandler)
+		if stats != nil {
+			stats.limiter = limiter
+		}
+	}
+	rootHandler = disconnectHandler(logger, stats, rootHandler)
+	if stats != nil {
+		rootHandler = stats.middleware(rootHandler)
+	}
+	if cfg.SlowLog > 0 {
+		rootHandler = slowLogHandler(logger.Logger, time.Duration(cfg.SlowLog), rootHandler)
+	}
+	rootHandler = drainHandler(draining, map[string]bool{cfg.HealthPath: true}, rootHandler)
+	if cfg.AccessLog {
+		rootHandler = accessLogHandler(logger.Logger, cfg.LogFormat, trusted, map[string]bool{cfg.HealthPath: true}, rootHandler)
+	}
+	if cfg.ServerHeader != nil {
+		rootHandler = serverHeaderHandler(*cfg.ServerHeader, rootHandler)
+	}
+	srv := newServer(cfg, rootHandler, logger.Logger)
+	// Let methodFilterHandler answer "OPTIONS *" like any other OPTIONS
+	srv.DisableGeneralOptionsHandler = true
+	srv.Protocols = serverProtocols(cfg.H2C)
+	if lr != nil {
+		srv.RegisterOnShutdown(lr.close)
+	}
+	if cfg.SelfSigned {
+		cert, err := generateSelfSignedCert(cfg.Host)
+		if err != nil {
+			logger.Fatalf("Failed to generate self-signed certificate: %v\n", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		logger.Infof("Generated self-signed certificate for %s (expires %s)\n", strings.Join(selfSignedNames(cfg.Host), ", "), cert.Leaf.NotAfter.Format(time.RFC3339))
+		logger.Infof("Certificate SHA-256 fingerprint: %s\n", certFingerprint(cert.Leaf.Raw))
+	} else if cfg.Cert != "" {
+		// Load the key pair now, while the files are still readable before
+		// --user drops privileges
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			logger.Fatalf("Failed to load TLS certificate: %v\n", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if srv.TLSConfig != nil {
+		srv.TLSConfig.MinVersion = tlsMin
+		srv.TLSConfig.CipherSuites = cipherSuites
+		if clientCAs != nil {
+			srv.TLSConfig.ClientCAs = clientCAs
+			srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
 	}
 
-	// Handle all requests with the static file server
-	http.Handle("/", http.FileServer(http.FS(publicFS)))
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	// A socket passed by systemd replaces --host, --port, and --unix
+	ln, err := systemdListener()
+	if err != nil {
+		logger.Fatalf("Failed to start server: %v\n", err)
+	}
+	var socketPath string
+	if ln != nil {
+		logger.Infof("Server starting at %s (socket from systemd, %s)\n", ln.Addr(), scheme)
+	} else if cfg.Unix != "" {
+		for _, name := range []string{"host", "port", "p", "ports"} {
+			if cl.set[name] {
+				logger.Infof("Note: --%s is ignored because --unix is set\n", name)
+			}
+		}
+		ln, err = listenUnix(cfg.Unix)
+		if err != nil {
+			logger.Fatalf("Failed to listen on Unix socket: %v\n", err)
+		}
+		socketPath = cfg.Unix
+		logger.Infof("Server starting at %s (Unix socket, %s)\n", cfg.Unix, scheme)
+	} else {
+		if _, err := listenAddr(cfg.Host, cfg.Port); err != nil {
+			logger.Fatalf("Invalid listen address: %v\n", err)
+		}
+		if len(ports) > 0 {
+			ln, err = listenPorts(cfg.Host, ports, logger)
+		} else {
+			ln, err = listenTCP(cfg.Host, cfg.Port, cfg.PortRetry, logger)
+		}
+		if err != nil {
+			logger.Fatalf("Failed to start server: %v\n", err)
+		}
+		// Report the port actually bound, which differs from --port after
+		// retries or when the OS picks one for --port 0
+		addr, _ := listenAddr(cfg.Host, ln.Addr().(*net.TCPAddr).Port)
+		logger.Infof("Server starting at %s://%s\n", scheme, addr)
+		for _, u := range lanURLs(scheme, ln.Addr()) {
+			logger.Infof("  Reachable on the network at %s\n", u)
+		}
+	}
+	tcpAddr, isTCP := ln.Addr().(*net.TCPAddr)
+	if cfg.Open {
+		if !isTCP {
+			logger.Infof("Note: --open is ignored because the server is not listening on TCP\n")
+		} else if err := openBrowser(browserURL(scheme, ln.Addr())); err != nil {
+			logger.Printf("Failed to open browser: %v\n", err)
+		}
+	}
 
-	addr := fmt.Sprintf("localhost:%d", port)
-	logger.Printf("Server starting at http://%s\n", addr)
+	var redirectSrv *http.Server
+	if cfg.RedirectHTTP != 0 {
+		if !isTCP {
+			logger.Fatalf("--redirect-http requires a TCP listener, not a Unix socket\n")
+		}
+		redirectAddr, err := listenAddr(cfg.Host, cfg.RedirectHTTP)
+		if err != nil {
+			logger.Fatalf("Invalid --redirect-http address: %v\n", err)
+		}
+		redirectLn, err := net.Listen("tcp", redirectAddr)
+		if err != nil {
+			logger.Fatalf("Failed to start HTTP redirect listener: %v\n", err)
+		}
+		redirectSrv = newServer(cfg, httpsRedirectHandler(tcpAddr.Port), logger.Logger)
+		go func() {
+			if err := redirectSrv.Serve(redirectLn); err != nil && err != http.ErrServerClosed {
+				logger.Printf("HTTP redirect server failed: %v\n", err)
+			}
+		}()
+		logger.Infof("Redirecting http://%s to HTTPS\n", redirectAddr)
+	}
+
+	if cfg.PIDFile != "" {
+		runningPID, err := writePIDFile(cfg.PIDFile)
+		if err != nil {
+			logger.Fatalf("Failed to write PID file: %v\n", err)
+		}
+		if runningPID != 0 {
+			logger.Printf("Warning: PID file %s belonged to running process %d, overwriting it\n", cfg.PIDFile, runningPID)
+		}
+	}
 
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if cfg.User != "" || cfg.Group != "" {
+		if err := dropPrivileges(cfg.User, cfg.Group); err != nil {
+			logger.Fatalf("Failed to drop privileges: %v\n", err)
+		}
+		logger.Infof("Running as uid %d, gid %d\n", os.Getuid(), os.Getgid())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if useTLS {
+			serveErr <- srv.ServeTLS(ln, "", "")
+		} else {
+			serveErr <- srv.Serve(ln)
+		}
+	}()
+	if readyHook != nil {
+		go runReadyHook(ctx, readyHook, ln.Addr().String(), logger)
+	}
+
+	select {
+	case err := <-serveErr:
 		logger.Fatalf("Failed to start server: %v\n", err)
+	case <-ctx.Done():
+	}
+	stopping.Store(true)
+	if delay := time.Duration(cfg.PreShutdownDelay); delay > 0 {
+		// Keep serving until load balancers have noticed the failing health
+		// checks; a second signal cuts the wait short
+		again, stopAgain := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		stop()
+		logger.Infof("Reporting unhealthy, still serving requests for %s before shutting down...\n", delay)
+		select {
+		case <-time.After(delay):
+		case <-again.Done():
+			logger.Infof("Signal received again, shutting down now\n")
+		}
+		stopAgain()
+	}
+	stop()
+
+	draining.Store(true)
+	logger.Infof("Shutting down, waiting up to %s for in-flight requests...\n", time.Duration(cfg.ShutdownTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Printf("Graceful shutdown did not finish, closing remaining connections: %v\n", err)
+		srv.Close()
+	}
+	if redirectSrv != nil {
+		if err := redirectSrv.Shutdown(shutdownCtx); err != nil {
+			redirectSrv.Close()
+		}
+	}
+	if socketPath != "" {
+		if err := os.Remove(socketPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Printf("Failed to remove Unix socket: %v\n", err)
+		}
+	}
+	if cfg.PIDFile != "" {
+		if err := os.Remove(cfg.PIDFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Printf("Failed to remove PID file: %v\n", err)
+		}
+	}
+	logger.Infof("Server stopped\n")
+}
+
+// normalizeBasePath returns p with exactly one leading and trailing slash.
+func normalizeBasePath(p string) string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return "/"
+	}
+	return "/" + p + "/"
+}
+
+// checkDir reports an error unless path is an existing, readable directory.
+func checkDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return fmt.Errorf("%s is not readable: %w", path, err)
 	}
+	return nil
 }
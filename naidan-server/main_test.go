@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+//go:embed testdata
+var testFiles embed.FS
+
+func testRoot(t *testing.T) http.FileSystem {
+	t.Helper()
+	sub, err := fs.Sub(testFiles, "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return http.FS(sub)
+}
+
+func TestRangeRequest(t *testing.T) {
+	root := testRoot(t)
+	handler := compressHandler(6, 0, 0, cacheControlHandler("max-age=3600", nil, http.FileServer(root)))
+
+	for _, name := range []string{"track.mp3", "notes.txt"} {
+		t.Run(name, func(t *testing.T) {
+			want, err := fs.ReadFile(testFiles, "testdata/"+name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/"+name, nil)
+			req.Header.Set("Range", "bytes=100-199")
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			res := rec.Result()
+			if res.StatusCode != http.StatusPartialContent {
+				t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusPartialContent)
+			}
+			if got, want := res.Header.Get("Content-Range"), fmt.Sprintf("bytes 100-199/%d", len(want)); got != want {
+				t.Errorf("Content-Range = %q, want %q", got, want)
+			}
+			if got := res.Header.Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q, want none", got)
+			}
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != string(want[100:200]) {
+				t.Errorf("body = %q, want %q", body, want[100:200])
+			}
+		})
+	}
+}
+
+func TestCompressedResponseHasNoAcceptRanges(t *testing.T) {
+	handler := compressHandler(6, 0, 0, http.FileServer(testRoot(t)))
+	req := httptest.NewRequest(http.MethodGet, "/notes.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := rec.Header().Get("Accept-Ranges"); got != "" {
+		t.Errorf("Accept-Ranges = %q, want none", got)
+	}
+}
+
+func TestMethodFilter(t *testing.T) {
+	handler := methodFilterHandler(defaultMethods, nil, http.FileServer(testRoot(t)))
+
+	req := httptest.NewRequest(http.MethodPost, "/notes.txt", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if got, want := rec.Header().Get("Allow"), "GET, HEAD, OPTIONS"; got != want {
+		t.Errorf("Allow = %q, want %q", got, want)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/notes.txt", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	handler := corsHandler([]string{"*"}, defaultMethods, methodFilterHandler(defaultMethods, nil, http.FileServer(testRoot(t))))
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		cors   bool
+	}{
+		{name: "plain"},
+		{name: "cross-origin", header: map[string]string{"Origin": "https://example.com"}, cors: true},
+		{name: "preflight", header: map[string]string{"Origin": "https://example.com", "Access-Control-Request-Method": "GET"}, cors: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodOptions, "/", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusNoContent)
+			}
+			if got, want := rec.Header().Get("Allow"), "GET, HEAD, OPTIONS"; got != want {
+				t.Errorf("Allow = %q, want %q", got, want)
+			}
+			wantOrigin, wantMethods := "", ""
+			if tt.cors {
+				wantOrigin, wantMethods = "*", "GET, HEAD, OPTIONS"
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, wantOrigin)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Methods"); got != wantMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, wantMethods)
+			}
+		})
+	}
+}
+
+func TestH2C(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.FileServer(testRoot(t)))
+	srv.Config.Protocols = serverProtocols(true)
+	srv.Start()
+	defer srv.Close()
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	res, err := client.Get(srv.URL + "/notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.ProtoMajor != 2 {
+		t.Errorf("protocol = %s, want HTTP/2", res.Proto)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	want, err := fs.ReadFile(testFiles, "testdata/notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != string(want) {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestNoKeepAlive(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		noKeepAlive bool
+		wantConns   int64
+	}{
+		{name: "default", wantConns: 1},
+		{name: "no-keepalive", noKeepAlive: true, wantConns: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.NoKeepAlive = tt.noKeepAlive
+			handler := http.FileServer(testRoot(t))
+			srv := httptest.NewUnstartedServer(handler)
+			srv.Config = newServer(cfg, handler, nil)
+			var conns atomic.Int64
+			srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			srv.Start()
+			defer srv.Close()
+
+			for i := range 2 {
+				res, err := srv.Client().Get(srv.URL + "/notes.txt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+
+				// The client consumes Connection: close into res.Close
+				if res.Close != tt.noKeepAlive {
+					t.Errorf("request %d: Connection: close = %v, want %v", i, res.Close, tt.noKeepAlive)
+				}
+			}
+			if got := conns.Load(); got != tt.wantConns {
+				t.Errorf("server accepted %d connections, want %d", got, tt.wantConns)
+			}
+		})
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		level int
+		want  string
+	}{
+		{name: "normal", level: levelNormal},
+		{name: "verbose", level: levelVerbose, want: "Client disconnected during GET /large"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			stats := newMetrics()
+			done := make(chan struct{})
+			large := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				chunk := make([]byte, 32<<10)
+				// Write until the closed connection fails a write
+				for range 1 << 12 {
+					if _, err := w.Write(chunk); err != nil {
+						return
+					}
+				}
+			})
+			handler := disconnectHandler(newLeveledLogger(&logs, tt.level), stats, large)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(done)
+				handler.ServeHTTP(w, r)
+			}))
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(conn, "GET /large HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			<-done
+
+			if got := stats.disconnects.Load(); got != 1 {
+				t.Errorf("disconnects = %d, want 1", got)
+			}
+			if tt.want == "" && logs.Len() > 0 {
+				t.Errorf("logged %q, want nothing", logs.String())
+			}
+			if tt.want != "" && !strings.Contains(logs.String(), tt.want) {
+				t.Errorf("logged %q, want it to contain %q", logs.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRedirects(t *testing.T) {
+	tests := []struct {
+		entry string
+		to    string
+		code  int
+	}{
+		{entry: "/old=/new", to: "/new", code: http.StatusMovedPermanently},
+		{entry: "/old=/new=302", to: "/new", code: http.StatusFound},
+		{entry: "/old=/search?id=301", to: "/search?id=301", code: http.StatusMovedPermanently},
+		{entry: "/old=/search?id=301=307", to: "/search?id=301", code: http.StatusTemporaryRedirect},
+		{entry: "/old=/new?page=2", to: "/new?page=2", code: http.StatusMovedPermanently},
+		{entry: "/old=https://example.com/?a=1&b=308", to: "https://example.com/?a=1&b=308", code: http.StatusMovedPermanently},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			rules, err := parseRedirects([]string{tt.entry})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rules[0]; got.to != tt.to || got.code != tt.code {
+				t.Errorf("got to=%q code=%d, want to=%q code=%d", got.to, got.code, tt.to, tt.code)
+			}
+		})
+	}
+}
+
+func TestDotfiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{".env", ".git/config", ".well-known/security.txt", "assets/.cache", "notes.txt"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := dotfileHandler(http.FileServer(dotfileFS{http.Dir(dir)}))
+	get := func(p string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		return rec
+	}
+
+	for p, want := range map[string]int{
+		"/.env":                     http.StatusNotFound,
+		"/.git/config":              http.StatusNotFound,
+		"/assets/.cache":            http.StatusNotFound,
+		"/.well-known/security.txt": http.StatusOK,
+		"/notes.txt":                http.StatusOK,
+	} {
+		if got := get(p).Code; got != want {
+			t.Errorf("GET %s: status = %d, want %d", p, got, want)
+		}
+	}
+
+	for p, wantNames := range map[string][]string{
+		"/":        {".well-known/", "assets/", "notes.txt"},
+		"/assets/": nil,
+	} {
+		body := get(p).Body.String()
+		for _, name := range wantNames {
+			if !strings.Contains(body, ">"+name+"<") {
+				t.Errorf("listing of %s lacks %s:\n%s", p, name, body)
+			}
+		}
+		for _, hidden := range []string{".env", ".git", ".cache"} {
+			if strings.Contains(body, hidden) {
+				t.Errorf("listing of %s shows %s:\n%s", p, hidden, body)
+			}
+		}
+	}
+
+	entries, err := readListing(dotfileFS{http.Dir(dir)}, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	if got, want := strings.Join(names, ","), ".well-known,assets,notes.txt"; got != want {
+		t.Errorf("readListing = %s, want %s", got, want)
+	}
+}
+
+func TestEnvInjectI18nIndex(t *testing.T) {
+	dir := t.TempDir()
+	for _, lang := range []string{"", ".ja", ".fr"} {
+		page := "<html lang=\"" + lang + "\">" + envPlaceholder + "</html>"
+		if err := os.WriteFile(filepath.Join(dir, "index"+lang+".html"), []byte(page), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script, err := parseEnvInject([]string{"API=https://api.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := http.Dir(dir)
+	handler := i18nIndexHandler(root, "index.html", envInjectHandler(root, "index.html", script, http.FileServer(root)))
+
+	for _, tt := range []struct {
+		path, acceptLanguage, wantLang string
+	}{
+		{path: "/", acceptLanguage: "ja,en;q=0.5", wantLang: ".ja"},
+		{path: "/", acceptLanguage: "fr-CA", wantLang: ".fr"},
+		{path: "/", acceptLanguage: "de", wantLang: ""},
+		{path: "/index.ja.html", wantLang: ".ja"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Header.Set("Accept-Language", tt.acceptLanguage)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		body := rec.Body.String()
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s (%s): status = %d, want %d", tt.path, tt.acceptLanguage, rec.Code, http.StatusOK)
+		}
+		if want := "<html lang=\"" + tt.wantLang + "\">" + string(script) + "</html>"; body != want {
+			t.Errorf("GET %s (%s): body = %q, want %q", tt.path, tt.acceptLanguage, body, want)
+		}
+	}
+}
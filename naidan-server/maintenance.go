@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaintenancePage is served in maintenance mode without
+// -maintenance-page.
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Under maintenance</title></head>
+<body><h1>Under maintenance</h1><p>Please try again in a few minutes.</p></body>
+</html>
+`
+
+// maintenance answers every request with 503 while enabled. It can be
+// toggled at runtime, e.g. by SIGUSR1.
+type maintenance struct {
+	enabled    atomic.Bool
+	page       []byte
+	retryAfter time.Duration
+	logger     *leveledLogger
+}
+
+// newMaintenance returns a disabled maintenance mode serving the HTML file at
+// pagePath, or a built-in page if pagePath is empty.
+func newMaintenance(pagePath string, retryAfter time.Duration, logger *leveledLogger) (*maintenance, error) {
+	page := []byte(defaultMaintenancePage)
+	if pagePath != "" {
+		var err error
+		if page, err = os.ReadFile(pagePath); err != nil {
+			return nil, err
+		}
+	}
+	return &maintenance{page: page, retryAfter: retryAfter, logger: logger}, nil
+}
+
+// set enables or disables maintenance mode and logs the change.
+func (m *maintenance) set(on bool) {
+	if m.enabled.Swap(on) == on {
+		return
+	}
+	if on {
+		m.logger.Printf("Entered maintenance mode, answering requests with 503\n")
+	} else {
+		m.logger.Printf("Exited maintenance mode\n")
+	}
+}
+
+// toggle flips maintenance mode.
+func (m *maintenance) toggle() {
+	m.set(!m.enabled.Load())
+}
+
+// middleware answers requests with the maintenance page while enabled,
+// except for paths in skip.
+func (m *maintenance) middleware(skip map[string]bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.enabled.Load() || skip[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		h.Set("Cache-Control", "no-store")
+		if m.retryAfter > 0 {
+			h.Set("Retry-After", strconv.Itoa(int(m.retryAfter.Round(time.Second)/time.Second)))
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if r.Method != http.MethodHead {
+			w.Write(m.page)
+		}
+	})
+}
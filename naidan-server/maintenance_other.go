@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyMaintenanceToggle does nothing; there is no SIGUSR1 on this platform.
+func notifyMaintenanceToggle(c chan<- os.Signal) {}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyMaintenanceToggle relays SIGUSR1, which toggles maintenance mode,
+// to c.
+func notifyMaintenanceToggle(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
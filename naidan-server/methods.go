@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// defaultMethods are the methods a static server has meaning for.
+var defaultMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// parseAllowedMethods returns the default methods followed by the extra
+// --allow-methods entries, upper-cased and without duplicates. Each entry
+// may hold a comma-separated list.
+func parseAllowedMethods(extra []string) ([]string, error) {
+	methods := slices.Clone(defaultMethods)
+	if len(extra) == 0 {
+		return methods, nil
+	}
+	for _, m := range strings.Split(strings.Join(extra, ","), ",") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m == "" || strings.IndexFunc(m, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+			return nil, fmt.Errorf("invalid method %q", m)
+		}
+		if !slices.Contains(methods, m) {
+			methods = append(methods, m)
+		}
+	}
+	return methods, nil
+}
+
+// methodFilterHandler answers 405 Method Not Allowed for methods outside
+// allowed, and 204 No Content for OPTIONS, both with an Allow header.
+// Requests for which exempt reports true, such as those forwarded to a
+// backend with --proxy, are passed through with any method.
+func methodFilterHandler(allowed []string, exempt func(path string) bool, next http.Handler) http.Handler {
+	allow := strings.Join(allowed, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case exempt != nil && exempt(r.URL.Path):
+			next.ServeHTTP(w, r)
+		case r.Method == http.MethodOptions:
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+		case slices.Contains(allowed, r.Method):
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Allow", allow)
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the request duration
+// histogram.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// requestKey labels the request counter.
+type requestKey struct {
+	method string
+	code   int
+}
+
+// metricMethods are the methods counted under their own name; any other
+// is counted as "other", so clients can't add series with made-up methods.
+var metricMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+// metrics collects request statistics for the Prometheus endpoint.
+type metrics struct {
+	inFlight    atomic.Int64
+	disconnects atomic.Uint64       // counted by disconnectHandler
+	limiter     *concurrencyLimiter // set with --max-connections
+
+	mu              sync.Mutex
+	requests        map[requestKey]uint64
+	bytesByType     map[string]uint64
+	durationCounts  []uint64 // cumulative per bucket in durationBuckets
+	durationSum     float64
+	durationSamples uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:       map[requestKey]uint64{},
+		bytesByType:    map[string]uint64{},
+		durationCounts: make([]uint64, len(durationBuckets)),
+	}
+}
+
+// observe records a finished request.
+func (m *metrics) observe(method string, code int, contentType string, bytes int64, d time.Duration) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "unknown"
+	}
+	seconds := d.Seconds()
+	if !slices.Contains(metricMethods, method) {
+		method = "other"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{method, code}]++
+	m.bytesByType[mediaType] += uint64(bytes)
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			m.durationCounts[i]++
+		}
+	}
+	m.durationSum += seconds
+	m.durationSamples++
+}
+
+// middleware records every request passing through next.
+func (m *metrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		m.observe(r.Method, rec.status, rec.Header().Get("Content-Type"), rec.bytes, time.Since(start))
+	})
+}
+
+// handler serves the collected metrics in the Prometheus text format.
+func (m *metrics) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		addVary(w.Header(), "Accept")
+		openMetrics := acceptsOpenMetrics(r)
+		if openMetrics {
+			w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		}
+		m.writeText(w, openMetrics)
+	})
+}
+
+// acceptsOpenMetrics reports whether r asks for the OpenMetrics format.
+func acceptsOpenMetrics(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == "application/openmetrics-text" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeText renders the metrics in the Prometheus text exposition format,
+// or in OpenMetrics when openMetrics is set. The samples are the same in
+// both; OpenMetrics only adds units and end marker and names counter
+// families without their _total suffix.
+func (m *metrics) writeText(w io.Writer, openMetrics bool) {
+	describe := func(name, typ, unit, help string) {
+		if openMetrics && typ == "counter" {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		if openMetrics && unit != "" {
+			fmt.Fprintf(w, "# UNIT %s %s\n", name, unit)
+		}
+	}
+	if openMetrics {
+		defer fmt.Fprintf(w, "# EOF\n")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	describe("naidan_http_requests_total", "counter", "", "Total number of HTTP requests.")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "naidan_http_requests_total{method=%s,code=\"%d\"} %d\n", quoteLabel(k.method), k.code, m.requests[k])
+	}
+
+	describe("naidan_http_requests_in_flight", "gauge", "", "Number of HTTP requests currently being served.")
+	fmt.Fprintf(w, "naidan_http_requests_in_flight %d\n", m.inFlight.Load())
+	if m.limiter != nil {
+		describe("naidan_http_concurrency_slots_in_use", "gauge", "", "Request slots taken out of --max-connections.")
+		fmt.Fprintf(w, "naidan_http_concurrency_slots_in_use %d\n", m.limiter.inUse())
+		describe("naidan_http_concurrency_limit", "gauge", "", "Maximum number of requests handled at once.")
+		fmt.Fprintf(w, "naidan_http_concurrency_limit %d\n", cap(m.limiter.slots))
+		describe("naidan_http_concurrency_rejected_total", "counter", "", "Requests rejected because every slot was taken.")
+		fmt.Fprintf(w, "naidan_http_concurrency_rejected_total %d\n", m.limiter.rejected.Load())
+	}
+
+	describe("naidan_http_client_disconnects_total", "counter", "", "Requests whose client went away before the response was sent.")
+	fmt.Fprintf(w, "naidan_http_client_disconnects_total %d\n", m.disconnects.Load())
+
+	describe("naidan_http_request_duration_seconds", "histogram", "seconds", "Time spent serving HTTP requests.")
+	for i, le := range durationBuckets {
+		fmt.Fprintf(w, "naidan_http_request_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), m.durationCounts[i])
+	}
+	fmt.Fprintf(w, "naidan_http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationSamples)
+	fmt.Fprintf(w, "naidan_http_request_duration_seconds_sum %s\n", strconv.FormatFloat(m.durationSum, 'g', -1, 64))
+	fmt.Fprintf(w, "naidan_http_request_duration_seconds_count %d\n", m.durationSamples)
+
+	describe("naidan_http_response_bytes_total", "counter", "bytes", "Response body bytes served, by content type.")
+	types := make([]string, 0, len(m.bytesByType))
+	for t := range m.bytesByType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(w, "naidan_http_response_bytes_total{content_type=%s} %d\n", quoteLabel(t), m.bytesByType[t])
+	}
+}
+
+// quoteLabel quotes a Prometheus label value.
+func quoteLabel(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// hookResponseWriter calls beforeHeader once, right before the status line is
+// written, so middleware can adjust headers set by the wrapped handler.
+type hookResponseWriter struct {
+	http.ResponseWriter
+	beforeHeader func(code int)
+	wroteHeader  bool
+}
+
+func (w *hookResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.beforeHeader(code)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *hookResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *hookResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *hookResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// injectResponseWriter buffers uncompressed HTML responses of any status,
+// such as the --404-page, and writes them through rewrite when finished;
+// other responses, and partial content, pass through. rewrite may also
+// adjust the response headers.
+type injectResponseWriter struct {
+	http.ResponseWriter
+	rewrite     func(page []byte) []byte
+	buf         *bytes.Buffer
+	code        int
+	wroteHeader bool
+}
+
+func (w *injectResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if code != http.StatusPartialContent && code != http.StatusNotModified && code != http.StatusNoContent &&
+		mediaType == "text/html" && h.Get("Content-Encoding") == "" {
+		w.buf, w.code = new(bytes.Buffer), code
+		// The body no longer matches the file
+		h.Del("Content-Length")
+		h.Del("ETag")
+		h.Del("Accept-Ranges")
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *injectResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buf != nil {
+		return w.buf.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *injectResponseWriter) Flush() {
+	if w.buf == nil {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+func (w *injectResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish writes the buffered page through rewrite.
+func (w *injectResponseWriter) finish() {
+	if w.buf == nil {
+		return
+	}
+	page := w.rewrite(w.buf.Bytes())
+	w.ResponseWriter.WriteHeader(w.code)
+	w.ResponseWriter.Write(page)
+}
+
+// cacheControlHandler sets Cache-Control on successful responses. HTML is
+// always revalidated so the app shell updates promptly, files whose names
+// match hashed are cached forever, and everything else gets defaultValue.
+func cacheControlHandler(defaultValue string, hashed *regexp.Regexp, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &hookResponseWriter{ResponseWriter: w}
+		hw.beforeHeader = func(code int) {
+			h := w.Header()
+			if h.Get("Cache-Control") != "" || (code != http.StatusOK && code != http.StatusPartialContent && code != http.StatusNotModified) {
+				return
+			}
+			mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+			switch {
+			case mediaType == "text/html":
+				h.Set("Cache-Control", "no-cache")
+			case hashed != nil && hashed.MatchString(path.Base(r.URL.Path)):
+				h.Set("Cache-Control", "max-age=31536000, immutable")
+			case defaultValue != "":
+				h.Set("Cache-Control", defaultValue)
+			}
+		}
+		next.ServeHTTP(hw, r)
+	})
+}
+
+// noCacheHandler forbids caching of every response and disables conditional
+// requests, so clients always get the current content in full. It overrides
+// whatever Cache-Control the wrapped handlers set.
+func noCacheHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Without validators the file server never answers 304
+		r.Header.Del("If-None-Match")
+		r.Header.Del("If-Modified-Since")
+		hw := &hookResponseWriter{ResponseWriter: w}
+		hw.beforeHeader = func(code int) {
+			h := w.Header()
+			h.Set("Cache-Control", "no-store, must-revalidate")
+			h.Set("Pragma", "no-cache")
+			h.Set("Expires", "0")
+			h.Del("ETag")
+			h.Del("Last-Modified")
+		}
+		next.ServeHTTP(hw, r)
+	})
+}
+
+// maxBodyHandler rejects requests whose body is larger than limit with 413
+// Request Entity Too Large. Bodies of unknown length are cut off at the
+// limit, and handlers reading past it get an *http.MaxBytesError.
+func maxBodyHandler(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "413 request entity too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// securityHeadersHandler sets hardening headers before the wrapped handler
+// writes anything. The baseline headers are added when baseline is true and
+// Content-Security-Policy whenever csp is non-empty.
+func securityHeadersHandler(baseline bool, csp string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if baseline {
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("X-Frame-Options", "DENY")
+			h.Set("Referrer-Policy", "no-referrer")
+		}
+		if csp != "" {
+			h.Set("Content-Security-Policy", csp)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseHeaders parses "Name: Value" entries of the -header flag.
+func parseHeaders(entries []string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%q is not of the form Name: Value", entry)
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// customHeadersHandler adds headers to every response. They are set before
+// the wrapped handler runs, so headers it sets itself take their place.
+func customHeadersHandler(headers http.Header, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		for name, values := range headers {
+			h[name] = append([]string(nil), values...)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serverTimingHandler reports how long next took until it started writing
+// the response in a Server-Timing header.
+func serverTimingHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		hw := &hookResponseWriter{ResponseWriter: w}
+		hw.beforeHeader = func(code int) {
+			dur := float64(time.Since(start).Microseconds()) / 1000
+			w.Header().Add("Server-Timing", fmt.Sprintf("app;dur=%.2f", dur))
+		}
+		next.ServeHTTP(hw, r)
+	})
+}
+
+// serverHeaderHandler sets the Server header to value right before the
+// response is written, or removes it if value is empty.
+func serverHeaderHandler(value string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &hookResponseWriter{ResponseWriter: w}
+		hw.beforeHeader = func(code int) {
+			if value == "" {
+				w.Header().Del("Server")
+			} else {
+				w.Header().Set("Server", value)
+			}
+		}
+		next.ServeHTTP(hw, r)
+	})
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// dropPrivileges is not available on this platform.
+func dropPrivileges(userName, groupName string) error {
+	return errors.New("--user and --group are unsupported on this OS")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// proxyRule forwards requests under prefix to target.
+type proxyRule struct {
+	prefix string
+	target *url.URL
+}
+
+// parseProxies parses --proxy entries of the form /prefix=http://host:port.
+func parseProxies(entries []string) ([]proxyRule, error) {
+	var rules []proxyRule
+	for _, e := range entries {
+		prefix, rawURL, ok := strings.Cut(e, "=")
+		prefix = strings.TrimSuffix(prefix, "/")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("%q is not /prefix=http://host:port", e)
+		}
+		target, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", e, err)
+		}
+		if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("%q: target must be an http or https URL", e)
+		}
+		rules = append(rules, proxyRule{prefix: prefix, target: target})
+	}
+	return rules, nil
+}
+
+// handler forwards requests to the rule's target, removing the prefix from
+// the path first when strip is set. The backend is addressed by its own host
+// name and sees the original host and scheme in X-Forwarded-Host and
+// X-Forwarded-Proto, and unreachable backends
+// are answered with 502 Bad Gateway.
+func (rule proxyRule) handler(strip bool, logger *leveledLogger) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(rule.target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		if strip {
+			r.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, rule.prefix), "/")
+			r.URL.RawPath = ""
+		}
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		r.Header.Set("X-Forwarded-Host", r.Host)
+		r.Header.Set("X-Forwarded-Proto", proto)
+		director(r)
+		// Name-based virtual hosts on the backend expect their own name
+		r.Host = rule.target.Host
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "413 request entity too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// disconnectHandler logs it; there is no one to answer
+		if isClientGone(err) {
+			return
+		}
+		logger.Printf("Proxy to %s failed: %v\n", rule.target, err)
+		http.Error(w, "502 bad gateway", http.StatusBadGateway)
+	}
+	return proxy
+}
+
+// proxied reports whether p is forwarded by one of rules.
+func proxied(rules []proxyRule, p string) bool {
+	for _, rule := range rules {
+		if p == rule.prefix || strings.HasPrefix(p, rule.prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rewriteRule maps request paths matching from to to. A from ending in "*"
+// matches every path with that prefix, and the rest of the path replaces a
+// "*" at the end of to, so "/old/*=/new/*" maps /old/a.html to /new/a.html.
+// Other rules match the path exactly.
+type rewriteRule struct {
+	from, to string
+	code     int // redirect status; 0 for internal rewrites
+}
+
+// match returns the target for p, if the rule applies to it.
+func (rule rewriteRule) match(p string) (string, bool) {
+	prefix, isPrefix := strings.CutSuffix(rule.from, "*")
+	if !isPrefix {
+		return rule.to, p == rule.from
+	}
+	rest, ok := strings.CutPrefix(p, prefix)
+	if !ok {
+		return "", false
+	}
+	if to, ok := strings.CutSuffix(rule.to, "*"); ok {
+		return to + rest, true
+	}
+	return rule.to, true
+}
+
+// parseRewrites parses --rewrite entries of the form from=to.
+func parseRewrites(entries []string) ([]rewriteRule, error) {
+	var rules []rewriteRule
+	for _, e := range entries {
+		from, to, ok := strings.Cut(e, "=")
+		if !ok || !strings.HasPrefix(from, "/") || !strings.HasPrefix(to, "/") {
+			return nil, fmt.Errorf("%q is not /from=/to", e)
+		}
+		rules = append(rules, rewriteRule{from: from, to: to})
+	}
+	return rules, nil
+}
+
+// parseRedirects parses --redirect entries of the form from=to or
+// from=to=code. The code defaults to 301 Moved Permanently. A trailing =NNN
+// is only taken as the code when NNN is a redirect status and the = doesn't
+// separate a query parameter from its value, so /old=/search?id=301 keeps
+// its query; /old=/search?id=301=302 gives it a code.
+func parseRedirects(entries []string) ([]rewriteRule, error) {
+	var rules []rewriteRule
+	for _, e := range entries {
+		from, to, ok := strings.Cut(e, "=")
+		if !ok || !strings.HasPrefix(from, "/") || to == "" {
+			return nil, fmt.Errorf("%q is not /from=to[=code]", e)
+		}
+		code := http.StatusMovedPermanently
+		if i := strings.LastIndex(to, "="); i >= 0 {
+			if c, err := strconv.Atoi(to[i+1:]); err == nil && isRedirectCode(c) && !endsInQueryKey(to[:i]) {
+				code, to = c, to[:i]
+			}
+		}
+		if to == "" {
+			return nil, fmt.Errorf("%q is not /from=to[=code]", e)
+		}
+		rules = append(rules, rewriteRule{from: from, to: to, code: code})
+	}
+	return rules, nil
+}
+
+// isRedirectCode reports whether code is accepted by --redirect.
+func isRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// endsInQueryKey reports whether target ends in a query parameter name
+// without a value, like /search?id, so an = after it starts the value.
+func endsInQueryKey(target string) bool {
+	_, query, ok := strings.Cut(target, "?")
+	if !ok {
+		return false
+	}
+	last := query[strings.LastIndex(query, "&")+1:]
+	return last != "" && !strings.Contains(last, "=")
+}
+
+// rewriteHandler applies redirects and then rewrites to the request path.
+// Redirects take precedence: a path matching both is redirected. Within
+// each kind the first matching rule wins, and a rewritten path is not
+// matched again.
+func rewriteHandler(redirects, rewrites []rewriteRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rule := range redirects {
+			if target, ok := rule.match(r.URL.Path); ok {
+				if r.URL.RawQuery != "" && !strings.Contains(target, "?") {
+					target += "?" + r.URL.RawQuery
+				}
+				w.Header().Set("Location", target)
+				w.WriteHeader(rule.code)
+				return
+			}
+		}
+		for _, rule := range rewrites {
+			if target, ok := rule.match(r.URL.Path); ok {
+				r = withPath(r, target)
+				break
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// systemdListener always returns nil; socket activation is Unix only.
+func systemdListener() (net.Listener, error) {
+	return nil, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// manifestEntry is one asset in a manifest written by build.go --manifest,
+// which maps paths relative to public, with forward slashes, to entries.
+type manifestEntry struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// verifyManifest checks the files under root against the manifest at
+// manifestPath, writing a line for every file that is missing, differs, or
+// isn't listed, and returns how many there were. The manifest's own copy
+// among the files, and the .gz and .br variants that build.go --compress
+// writes after the manifest, are not reported as unlisted.
+func verifyManifest(root http.FileSystem, manifestPath string, w io.Writer) (int, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return 0, err
+	}
+	var want map[string]manifestEntry
+	if err := json.Unmarshal(data, &want); err != nil {
+		return 0, fmt.Errorf("parse %s: %w", manifestPath, err)
+	}
+
+	var files []fileEntry
+	if err := listFiles(root, "/", &files); err != nil {
+		return 0, err
+	}
+	slices.SortFunc(files, func(a, b fileEntry) int { return strings.Compare(a.Path, b.Path) })
+	have := make(map[string]bool, len(files))
+	problems := 0
+	for _, f := range files {
+		name := strings.TrimPrefix(f.Path, "/")
+		have[name] = true
+		entry, ok := want[name]
+		if !ok {
+			if !isManifestOrVariant(name, filepath.Base(manifestPath), want) {
+				fmt.Fprintf(w, "EXTRA     %s\n", name)
+				problems++
+			}
+			continue
+		}
+		sum, err := hashFile(root, f.Path)
+		if err != nil {
+			return problems, err
+		}
+		if f.Size != entry.Size || !strings.EqualFold(sum, entry.SHA256) {
+			fmt.Fprintf(w, "MISMATCH  %s\n", name)
+			problems++
+		}
+	}
+	var missing []string
+	for name := range want {
+		if !have[name] {
+			missing = append(missing, name)
+		}
+	}
+	slices.Sort(missing)
+	for _, name := range missing {
+		fmt.Fprintf(w, "MISSING   %s\n", name)
+		problems++
+	}
+	return problems, nil
+}
+
+// isManifestOrVariant reports whether name, which manifest doesn't list, is
+// the manifest file itself or a compressed variant of a file that is
+// expected there.
+func isManifestOrVariant(name, manifestName string, manifest map[string]manifestEntry) bool {
+	if name == manifestName {
+		return true
+	}
+	ext := path.Ext(name)
+	if ext != ".gz" && ext != ".br" {
+		return false
+	}
+	original := strings.TrimSuffix(name, ext)
+	_, listed := manifest[original]
+	return listed || original == manifestName
+}
+
+// hashFile returns the hex SHA-256 of the file name in root.
+func hashFile(root http.FileSystem, name string) (string, error) {
+	f, err := root.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
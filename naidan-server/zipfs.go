@@ -0,0 +1,121 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// zipFS serves the files of a ZIP archive. Unlike zip.Reader's own fs.FS,
+// its files are seekable, which http.FileServer needs for Content-Length and
+// Range requests.
+type zipFS struct {
+	r     *zip.Reader
+	ra    io.ReaderAt
+	files map[string]*zip.File
+}
+
+// openZipFS opens the archive at path and checks that it can be read.
+func openZipFS(path string) (*zipFS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a valid ZIP archive: %w", path, err)
+	}
+	z := &zipFS{r: r, ra: f, files: make(map[string]*zip.File)}
+	for _, zf := range r.File {
+		z.files[zf.Name] = zf
+	}
+	return z, nil
+}
+
+func (z *zipFS) Open(name string) (fs.File, error) {
+	f, err := z.r.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return f, nil
+	}
+	f.Close()
+
+	// Stored entries are read in place; compressed ones are only inflated
+	// into memory once read, since most opens are just to stat the file
+	file := &zipFile{info: info, open: func() (io.ReadCloser, error) { return z.r.Open(name) }}
+	if zf := z.files[name]; zf != nil && zf.Method == zip.Store {
+		offset, err := zf.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		file.content = io.NewSectionReader(z.ra, offset, int64(zf.UncompressedSize64))
+	}
+	return file, nil
+}
+
+// zipFile is a seekable file of a zipFS. Seeking only moves the offset, so
+// http.ServeContent can find the size without inflating the entry.
+type zipFile struct {
+	info    fs.FileInfo
+	open    func() (io.ReadCloser, error)
+	content io.ReaderAt // nil until the first Read of a compressed entry
+	offset  int64
+}
+
+func (f *zipFile) Read(p []byte) (int, error) {
+	if f.content == nil {
+		rc, err := f.open()
+		if err != nil {
+			return 0, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.info.Name(), Err: err}
+		}
+		f.content = bytes.NewReader(data)
+	}
+	if f.offset >= f.info.Size() {
+		return 0, io.EOF
+	}
+	n, err := f.content.ReadAt(p[:min(int64(len(p)), f.info.Size()-f.offset)], f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *zipFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.info.Name(), Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *zipFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *zipFile) Close() error { return nil }